@@ -0,0 +1,189 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// inspect verifies and describes a TUF repository archived with
+// repo.CompressFS, e.g. the "repository" entry of the secret created by the
+// tuf server.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/signals"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var (
+	archive    = flag.String("archive", "", "Path of the compressed TUF repository to inspect, or - for stdin. Either this or --secret is required.")
+	secretName = flag.String("secret", "", "Name of the secret holding the compressed TUF repository to inspect, e.g. tuf-root.")
+	secretKey  = flag.String("secret-key", "repository", "Key of the compressed TUF repository in --secret.")
+	namespace  = flag.String("namespace", "", "Namespace of --secret. Defaults to $NAMESPACE, or to the namespace of the current kubeconfig context.")
+	kubeconfig = flag.String("kubeconfig", "", "Path of the kubeconfig used to get --secret. Defaults to $KUBECONFIG, ~/.kube/config or the in-cluster config.")
+	output     = flag.String("output", outputText, "Output format, one of: text, json")
+)
+
+// readArchive reads the compressed TUF repository from --archive or --secret.
+func readArchive(ctx context.Context) ([]byte, error) {
+	switch {
+	case *archive != "" && *secretName != "":
+		return nil, errors.New("only one of --archive and --secret can be given")
+	case *archive == "-":
+		return io.ReadAll(os.Stdin)
+	case *archive != "":
+		return os.ReadFile(*archive)
+	case *secretName != "":
+		return readSecret(ctx)
+	default:
+		return nil, errors.New("one of --archive and --secret is required")
+	}
+}
+
+// readSecret reads the compressed TUF repository from --secret.
+func readSecret(ctx context.Context) ([]byte, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeconfig: %w", err)
+	}
+	ns := *namespace
+	if ns == "" {
+		ns = os.Getenv("NAMESPACE")
+	}
+	if ns == "" {
+		if ns, _, err = clientConfig.Namespace(); err != nil {
+			return nil, fmt.Errorf("failed to get namespace: %w", err)
+		}
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clientset: %w", err)
+	}
+	s, err := clientset.CoreV1().Secrets(ns).Get(ctx, *secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", ns, *secretName, err)
+	}
+	data, ok := s.Data[*secretKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s does not contain %s", ns, *secretName, *secretKey)
+	}
+	return data, nil
+}
+
+// printText prints the inspection in a human readable format.
+func printText(w io.Writer, in *repo.Inspection) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tVERSION\tEXPIRES\tTHRESHOLD\tKEYS\tSIGNATURES")
+	for _, r := range in.Roles {
+		expires := r.Expires.Format(time.RFC3339)
+		if r.Expired {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\n", r.Name, r.Version, expires, r.Threshold, len(r.KeyIDs), r.Signatures)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "TARGET\tROLE\tLENGTH\tUSAGE\tSTATUS\tURI")
+	for _, t := range in.Targets {
+		custom := repo.CustomMetadata{}
+		if t.Sigstore != nil {
+			custom = *t.Sigstore
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", t.Name, t.Role, t.Length, custom.Usage, custom.Status, custom.URI)
+	}
+	if tr := in.TrustedRoot; tr != nil {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "TRUSTED ROOT\tURL\tID\tVALID FROM\tVALID UNTIL")
+		for _, ca := range tr.CertificateAuthorities {
+			fmt.Fprintf(tw, "certificate authority\t%s\t%s\t%s\t%s\n", ca.URI, ca.Subject, ca.ValidFrom.Format(time.RFC3339), formatTime(ca.ValidUntil))
+		}
+		for _, tsa := range tr.TimestampAuthorities {
+			fmt.Fprintf(tw, "timestamp authority\t%s\t%s\t%s\t%s\n", tsa.URI, tsa.Subject, tsa.ValidFrom.Format(time.RFC3339), formatTime(tsa.ValidUntil))
+		}
+		for _, tlog := range tr.TransparencyLogs {
+			fmt.Fprintf(tw, "transparency log\t%s\t%s\t%s\t%s\n", tlog.BaseURL, tlog.LogID, tlog.ValidFrom.Format(time.RFC3339), formatTime(tlog.ValidUntil))
+		}
+		for _, ctlog := range tr.CTLogs {
+			fmt.Fprintf(tw, "ct log\t%s\t%s\t%s\t%s\n", ctlog.BaseURL, ctlog.LogID, ctlog.ValidFrom.Format(time.RFC3339), formatTime(ctlog.ValidUntil))
+		}
+	}
+	fmt.Fprintln(tw)
+	if len(in.Errors) == 0 {
+		fmt.Fprintln(tw, "The repository was verified successfully.")
+	} else {
+		fmt.Fprintf(tw, "The repository failed verification:\n  %s\n", strings.Join(in.Errors, "\n  "))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func main() {
+	flag.Parse()
+	ctx := signals.NewContext()
+
+	if *output != outputText && *output != outputJSON {
+		logging.FromContext(ctx).Fatalf("unknown output format %s", *output)
+	}
+	compressed, err := readArchive(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Fatalf("failed to read the repository: %v", err)
+	}
+	fsys, err := repo.UncompressFS(bytes.NewReader(compressed))
+	if err != nil {
+		logging.FromContext(ctx).Fatalf("failed to uncompress the repository: %v", err)
+	}
+
+	in, err := repo.InspectRepo(fsys, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).Fatalf("failed to inspect the repository: %v", err)
+	}
+	if *output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(in)
+	} else {
+		err = printText(os.Stdout, in)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Fatalf("failed to print the inspection: %v", err)
+	}
+	if len(in.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// shortCacheControl is the Cache-Control header of the metadata. The
+	// unversioned metadata changes whenever the repository is refreshed or
+	// updated, and even versioned metadata like 1.root.json is replaced
+	// when the repository is created again with other inputs.
+	shortCacheControl = "public, max-age=60"
+	// immutableCacheControl is the Cache-Control header of the targets
+	// prefixed with their hash, which never change once they are published.
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+var hashedTargetRegexp = regexp.MustCompile(`^/targets/(?:.+/)?[0-9a-f]{64}(?:[0-9a-f]{64})?\.[^/]+$`)
+
+// cacheControl returns the Cache-Control header for the file of the TUF
+// repository at urlPath.
+func cacheControl(urlPath string) string {
+	if hashedTargetRegexp.MatchString(urlPath) {
+		return immutableCacheControl
+	}
+	return shortCacheControl
+}
+
+// repository is a TUF repository served by repoServer.
+type repository struct {
+	// name is the path prefix the repository is served under, or empty to
+	// serve it at the root.
+	name string
+	// files serves the files of the repository.
+	files http.Handler
+	// readFile reads a file of the repository that is currently served,
+	// e.g. "timestamp.json".
+	readFile func(name string) ([]byte, error)
+}
+
+// repoServer serves TUF repositories over HTTP, along with health and
+// readiness endpoints and Prometheus metrics. A single repository without a
+// name is served at the root, named repositories are served under their name
+// along with an index of all of them.
+type repoServer struct {
+	repositories []repository
+	// now returns the current time, for tests.
+	now     func() time.Time
+	metrics httpMetrics
+}
+
+func newRepoServer(repositories ...repository) *repoServer {
+	named := len(repositories) > 0 && repositories[0].name != ""
+	return &repoServer{repositories: repositories, now: time.Now, metrics: newHTTPMetrics(named)}
+}
+
+// handler returns the handler for all the endpoints of s.
+func (s *repoServer) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		for _, r := range s.repositories {
+			if _, err := s.timestampExpires(r); err != nil {
+				http.Error(w, repositoryError(r, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	// Like promhttp.Handler, but with a registry of its own so that every
+	// server only counts its own requests.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		s.metrics.requests,
+		s.metrics.duration,
+		newTimestampCollector(ctx, s),
+	)
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	for _, r := range s.repositories {
+		if r.name == "" {
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				s.serveFile(ctx, r, w, req)
+			})
+			continue
+		}
+		mux.Handle("/"+r.name+"/", http.StripPrefix("/"+r.name, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.serveFile(ctx, r, w, req)
+		})))
+	}
+	if len(s.repositories) > 0 && s.repositories[0].name != "" {
+		mux.HandleFunc("GET /index.json", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", shortCacheControl)
+			if err := json.NewEncoder(w).Encode(s.index()); err != nil {
+				logging.FromContext(ctx).Warnf("failed to write the repository index: %v", err)
+			}
+		})
+	}
+	return mux
+}
+
+// repositoryError returns the message of err about r.
+func repositoryError(r repository, err error) string {
+	if r.name == "" {
+		return err.Error()
+	}
+	return fmt.Sprintf("repository %s: %v", r.name, err)
+}
+
+// serveFile serves a file of r with the Cache-Control header matching it,
+// logs the request and records it in the metrics.
+func (s *repoServer) serveFile(ctx context.Context, r repository, w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	rec.Header().Set("Cache-Control", cacheControl(req.URL.Path))
+	r.files.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	duration := time.Since(start)
+	s.metrics.observe(r.name, req.Method, rec.status, duration)
+	logging.FromContext(ctx).Infow("served request", "repository", r.name, "method", req.Method, "path", req.URL.Path, "status", rec.status, "bytes", rec.bytes, "duration", duration, "remote", req.RemoteAddr, "userAgent", req.UserAgent())
+}
+
+// timestampExpires returns when the timestamp.json that is served for r
+// expires, and an error if it can't be read or already expired.
+func (s *repoServer) timestampExpires(r repository) (time.Time, error) {
+	b, err := r.readFile("timestamp.json")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read timestamp.json: %w", err)
+	}
+	timestamp, err := metadata.Timestamp().FromBytes(b)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse timestamp.json: %w", err)
+	}
+	if expires := timestamp.Signed.Expires; !s.now().Before(expires) {
+		return expires, fmt.Errorf("timestamp.json expired at %s", expires.Format(time.RFC3339))
+	}
+	return timestamp.Signed.Expires, nil
+}
+
+// repositoryIndex is the content of /index.json.
+type repositoryIndex struct {
+	Repositories []indexEntry `json:"repositories"`
+}
+
+// indexEntry describes a repository in /index.json. Clients bootstrap their
+// trust in a repository from its initial root, so its digest can be
+// compared with the one they were given out of band.
+type indexEntry struct {
+	Name              string `json:"name"`
+	Path              string `json:"path"`
+	RootVersion       int64  `json:"rootVersion,omitempty"`
+	RootSHA256        string `json:"rootSHA256,omitempty"`
+	InitialRootSHA256 string `json:"initialRootSHA256,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// index returns the index of the repositories that are served.
+func (s *repoServer) index() repositoryIndex {
+	index := repositoryIndex{Repositories: []indexEntry{}}
+	for _, r := range s.repositories {
+		entry := indexEntry{Name: r.name, Path: "/" + r.name + "/"}
+		if err := indexRoots(r, &entry); err != nil {
+			entry.Error = err.Error()
+		}
+		index.Repositories = append(index.Repositories, entry)
+	}
+	return index
+}
+
+// indexRoots fills in the root details of entry from the served metadata
+// of r.
+func indexRoots(r repository, entry *indexEntry) error {
+	b, err := r.readFile("root.json")
+	if err != nil {
+		return fmt.Errorf("failed to read root.json: %w", err)
+	}
+	root, err := metadata.Root().FromBytes(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse root.json: %w", err)
+	}
+	entry.RootVersion = root.Signed.Version
+	digest := sha256.Sum256(b)
+	entry.RootSHA256 = hex.EncodeToString(digest[:])
+	initial, err := r.readFile("1.root.json")
+	if err != nil {
+		return fmt.Errorf("failed to read 1.root.json: %w", err)
+	}
+	digest = sha256.Sum256(initial)
+	entry.InitialRootSHA256 = hex.EncodeToString(digest[:])
+	return nil
+}
+
+// serveRepo serves s on l, over HTTPS if a certificate and key are given,
+// until ctx is done. The requests in flight are then given
+// --shutdown-timeout to finish.
+func serveRepo(ctx context.Context, l net.Listener, s *repoServer, certFile, keyFile string) error {
+	srv := &http.Server{
+		Handler:           s.handler(ctx),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			errs <- srv.ServeTLS(l, certFile, keyFile)
+		} else {
+			errs <- srv.Serve(l)
+		}
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	logging.FromContext(ctx).Infof("shutting down the tuf server")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// responseRecorder records the status and size of a response. Error
+// responses must not be cached like the file that was requested, as
+// clients look for the next version of root.json until it is not found.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		if status >= http.StatusMultipleChoices && status != http.StatusNotModified {
+			r.Header().Del("Cache-Control")
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// httpMetrics holds the Prometheus metrics of the requests for the
+// repositories. The metrics of unnamed repositories have no repository
+// label.
+type httpMetrics struct {
+	// requests counts the requests by repository, method and status.
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	// named is set if the metrics have a repository label.
+	named bool
+}
+
+func newHTTPMetrics(named bool) httpMetrics {
+	requestLabels, durationLabels := []string{"method", "code"}, []string{}
+	if named {
+		requestLabels, durationLabels = []string{"repository", "method", "code"}, []string{"repository"}
+	}
+	return httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tuf_http_requests_total",
+			Help: "Number of requests for files of the TUF repository.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tuf_http_request_duration_seconds",
+			Help:    "Duration of the requests for files of the TUF repository.",
+			Buckets: prometheus.DefBuckets,
+		}, durationLabels),
+		named: named,
+	}
+}
+
+func (m httpMetrics) observe(repository, method string, status int, duration time.Duration) {
+	// Keep the number of label values small whatever clients send.
+	if method != http.MethodGet && method != http.MethodHead {
+		method = "other"
+	}
+	requestLabels, durationLabels := []string{method, strconv.Itoa(status)}, []string{}
+	if m.named {
+		requestLabels = append([]string{repository}, requestLabels...)
+		durationLabels = []string{repository}
+	}
+	m.requests.WithLabelValues(requestLabels...).Inc()
+	m.duration.WithLabelValues(durationLabels...).Observe(duration.Seconds())
+}
+
+// timestampCollector collects the expiration of the served timestamp.json
+// of each repository that can be read.
+type timestampCollector struct {
+	ctx  context.Context
+	s    *repoServer
+	desc *prometheus.Desc
+}
+
+func newTimestampCollector(ctx context.Context, s *repoServer) *timestampCollector {
+	var labels []string
+	if s.metrics.named {
+		labels = []string{"repository"}
+	}
+	return &timestampCollector{
+		ctx:  ctx,
+		s:    s,
+		desc: prometheus.NewDesc("tuf_timestamp_expiration_timestamp_seconds", "Time the served timestamp.json expires at, in seconds since the epoch.", labels, nil),
+	}
+}
+
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.s.repositories {
+		expires, err := c.s.timestampExpires(r)
+		if expires.IsZero() {
+			logging.FromContext(c.ctx).Warnf("failed to read the served timestamp.json: %s", repositoryError(r, err))
+			continue
+		}
+		var labels []string
+		if c.s.metrics.named {
+			labels = []string{r.name}
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(expires.Unix()), labels...)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+)
+
+// newTestRepoServer returns a repoServer for a new TUF repository.
+func newTestRepoServer(t *testing.T) *repoServer {
+	t.Helper()
+	return newRepoServer(testRepository(t, "", "rekor"))
+}
+
+// testRepository returns a new TUF repository with the given name and the
+// given content of its target.
+func testRepository(t *testing.T, name, content string) repository {
+	t.Helper()
+	compressed, _ := compressedRepo(t, "rekor.pub", content)
+	fsys, err := repo.UncompressFS(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Failed to UncompressFS: %v", err)
+	}
+	repoFS, err := fs.Sub(fsys, "repository")
+	if err != nil {
+		t.Fatalf("Failed to get repository directory: %v", err)
+	}
+	return repository{
+		name:  name,
+		files: http.FileServerFS(repoFS),
+		readFile: func(name string) ([]byte, error) {
+			return fs.ReadFile(repoFS, name)
+		},
+	}
+}
+
+func TestRepoServer(t *testing.T) {
+	s := newTestRepoServer(t)
+	server := httptest.NewServer(s.handler(context.Background()))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path         string
+		status       int
+		cacheControl string
+	}{
+		{"/timestamp.json", http.StatusOK, shortCacheControl},
+		{"/root.json", http.StatusOK, shortCacheControl},
+		{"/1.root.json", http.StatusOK, shortCacheControl},
+		{"/1.targets.json", http.StatusOK, shortCacheControl},
+		// Clients look for the next root version until it is not found.
+		{"/2.root.json", http.StatusNotFound, ""},
+		{"/healthz", http.StatusOK, ""},
+		{"/readyz", http.StatusOK, ""},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatalf("Failed to GET %s: %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", tc.path, tc.cacheControl, got)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/targets/6a0d8ce486b4aa7a2b30bf0940a879a00d1bb2738c4874543e179781d42b8ea1d12f34698dc95b3beeb9785036f7f2272e2fc92b994a04ac59ae458b5f4a2a7c.rekor.pub": immutableCacheControl,
+		"/targets/dir/3bc4d2ba0c8ff5f5b8d8dfa8e8c6d3b3a6bbec1e4c12a3cb27ae4e9d5de9b1c6.ctfe.pub":                                                              immutableCacheControl,
+		"/targets/rekor.pub":   shortCacheControl,
+		"/snapshot.json":       shortCacheControl,
+		"/12.rekor.json":       shortCacheControl,
+		"/1.root.json.tmp":     shortCacheControl,
+		"/targets/1.root.json": shortCacheControl,
+	} {
+		if got := cacheControl(path); got != want {
+			t.Errorf("%s: expected Cache-Control %q, got %q", path, want, got)
+		}
+	}
+
+	// Not ready once timestamp.json expired.
+	s.now = func() time.Time { return time.Now().AddDate(1, 0, 0) }
+	code, body := get(t, server, "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(string(body), "expired") {
+		t.Errorf("expected /readyz to fail for an expired timestamp, got %d: %s", code, body)
+	}
+
+	code, body = get(t, server, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("Failed to get metrics: %d", code)
+	}
+	for _, want := range []string{
+		`tuf_http_requests_total{code="200",method="GET"} 4`,
+		`tuf_http_requests_total{code="404",method="GET"} 1`,
+		`tuf_http_request_duration_seconds_bucket{le="+Inf"} 5`,
+		`tuf_http_request_duration_seconds_count 5`,
+		"tuf_timestamp_expiration_timestamp_seconds ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestRepoServerServesSeveralRepositories(t *testing.T) {
+	s := newRepoServer(testRepository(t, "prod", "prod"), testRepository(t, "staging", "staging"))
+	server := httptest.NewServer(s.handler(context.Background()))
+	defer server.Close()
+
+	code, body := get(t, server, "/index.json")
+	if code != http.StatusOK {
+		t.Fatalf("Failed to get index.json: %d: %s", code, body)
+	}
+	var index repositoryIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		t.Fatalf("Failed to parse index.json: %v", err)
+	}
+	if len(index.Repositories) != 2 {
+		t.Fatalf("expected 2 repositories, got %+v", index.Repositories)
+	}
+	for i, name := range []string{"prod", "staging"} {
+		entry := index.Repositories[i]
+		if entry.Name != name || entry.Path != "/"+name+"/" || entry.RootVersion != 1 || entry.Error != "" {
+			t.Errorf("unexpected index entry %+v", entry)
+		}
+		code, root := get(t, server, entry.Path+"root.json")
+		if code != http.StatusOK {
+			t.Fatalf("Failed to get root.json of %s: %d", name, code)
+		}
+		digest := sha256.Sum256(root)
+		if got := hex.EncodeToString(digest[:]); entry.RootSHA256 != got || entry.InitialRootSHA256 != got {
+			t.Errorf("%s: expected root digests %s, got %+v", name, got, entry)
+		}
+		if code, _ := get(t, server, entry.Path+"1.root.json"); code != http.StatusOK {
+			t.Errorf("%s: expected 1.root.json to be served, got %d", name, code)
+		}
+	}
+	if index.Repositories[0].RootSHA256 == index.Repositories[1].RootSHA256 {
+		t.Error("expected the repositories to have different roots")
+	}
+
+	// Files are only served under the prefix of a repository.
+	for _, path := range []string{"/root.json", "/dev/root.json"} {
+		if code, _ := get(t, server, path); code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusNotFound, code)
+		}
+	}
+	if code, _ := get(t, server, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected /readyz to succeed, got %d", code)
+	}
+
+	code, body = get(t, server, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("Failed to get metrics: %d", code)
+	}
+	for _, want := range []string{
+		`tuf_http_requests_total{code="200",method="GET",repository="prod"} 2`,
+		`tuf_http_requests_total{code="200",method="GET",repository="staging"} 2`,
+		`tuf_http_request_duration_seconds_count{repository="prod"} 2`,
+		`tuf_timestamp_expiration_timestamp_seconds{repository="prod"} `,
+		`tuf_timestamp_expiration_timestamp_seconds{repository="staging"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	// The server is not ready while any of the repositories expired.
+	s.now = func() time.Time { return time.Now().AddDate(1, 0, 0) }
+	code, body = get(t, server, "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(string(body), "repository prod") {
+		t.Errorf("expected /readyz to fail for an expired timestamp, got %d: %s", code, body)
+	}
+}
+
+func TestServeRepoShutsDown(t *testing.T) {
+	s := newTestRepoServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- serveRepo(ctx, l, s, "", "") }()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/timestamp.json")
+	if err != nil {
+		t.Fatalf("Failed to GET timestamp.json: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("expected a graceful shutdown, got %v", err)
+		}
+	case <-time.After(*shutdownTimeout):
+		t.Fatal("server did not shut down")
+	}
+}
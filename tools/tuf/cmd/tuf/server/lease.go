@@ -0,0 +1,198 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/logging"
+)
+
+// leasePollInterval is how soon a replica waiting for a lease first checks
+// whether it was released. The interval doubles with every check, up to the
+// duration of the lease.
+var leasePollInterval = time.Second
+
+// acquireLease blocks until holder holds the lease name in ns, or ctx is
+// done. The lease is renewed in the background until the returned function is
+// called, which releases it. The returned context is canceled once the lease
+// is lost, so the holder can stop what it holds the lease for. A lease that
+// was not renewed for duration, e.g. because its holder crashed, is taken
+// over.
+func acquireLease(ctx context.Context, clientset kubernetes.Interface, ns, name, holder string, duration time.Duration) (context.Context, func(), error) {
+	leases := clientset.CoordinationV1().Leases(ns)
+	/* #nosec G115 */
+	seconds := int32(min(math.Ceil(duration.Seconds()), math.MaxInt32))
+	interval := leasePollInterval
+	// waitingFor is the holder of the lease when it was last checked.
+	waitingFor := ""
+	for {
+		now := metav1.NowMicro()
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case apierrs.IsNotFound(err):
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &holder,
+					LeaseDurationSeconds: &seconds,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}
+			lease, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to get lease %s/%s: %w", ns, name, err)
+		case leaseExpired(lease, now.Time):
+			logging.FromContext(ctx).Infof("taking over expired lease %s/%s", ns, name)
+			lease.Spec.HolderIdentity = &holder
+			lease.Spec.LeaseDurationSeconds = &seconds
+			lease.Spec.AcquireTime = &now
+			lease.Spec.RenewTime = &now
+			// Fails with a conflict if the lease changed since it was read.
+			lease, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		default:
+			if current := *lease.Spec.HolderIdentity; current != waitingFor {
+				logging.FromContext(ctx).Infof("waiting for lease %s/%s held by %s", ns, name, current)
+				waitingFor = current
+			}
+			err = errLeaseHeld
+		}
+		if err == nil {
+			heldCtx, release := renewLease(ctx, clientset, lease, duration)
+			return heldCtx, release, nil
+		}
+		if err != errLeaseHeld && !apierrs.IsAlreadyExists(err) && !apierrs.IsConflict(err) {
+			logging.FromContext(ctx).Warnf("failed to acquire lease %s/%s: %v", ns, name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("failed to acquire lease %s/%s: %w", ns, name, ctx.Err())
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, duration)
+	}
+}
+
+// errLeaseHeld is returned internally by acquireLease while another holder
+// holds the lease.
+var errLeaseHeld = errors.New("lease is held")
+
+// leaseHeld returns whether the lease name in ns is currently held.
+func leaseHeld(ctx context.Context, clientset kubernetes.Interface, ns, name string) (bool, error) {
+	lease, err := clientset.CoordinationV1().Leases(ns).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrs.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to get lease %s/%s: %w", ns, name, err)
+	}
+	return !leaseExpired(lease, time.Now()), nil
+}
+
+// leaseExpired returns whether lease is not held by anyone as of now.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// renewLease renews the acquired lease every third of duration until the
+// returned function is called, which deletes the lease. The returned context
+// is canceled once the lease is lost: when another holder took it over, it
+// was deleted, or it could not be renewed for duration.
+func renewLease(ctx context.Context, clientset kubernetes.Interface, lease *coordinationv1.Lease, duration time.Duration) (context.Context, func()) {
+	leases := clientset.CoordinationV1().Leases(lease.Namespace)
+	holder := *lease.Spec.HolderIdentity
+	heldCtx, lose := context.WithCancel(ctx)
+	renewCtx, cancel := context.WithCancel(ctx)
+	// lost is only written by the renewing goroutine, and read once it is
+	// done.
+	lost := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(duration / 3)
+		defer ticker.Stop()
+		renewed := lease.Spec.RenewTime.Time
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := metav1.NowMicro()
+			lease.Spec.RenewTime = &now
+			updated, err := leases.Update(renewCtx, lease, metav1.UpdateOptions{})
+			if err == nil {
+				lease, renewed = updated, now.Time
+				continue
+			}
+			if apierrs.IsConflict(err) {
+				// The lease changed since it was last renewed, find out
+				// whether it is still held.
+				current, getErr := leases.Get(renewCtx, lease.Name, metav1.GetOptions{})
+				switch {
+				case getErr != nil:
+					err = getErr
+				case current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != holder:
+					err, lost = errors.New("lease was taken over"), true
+				default:
+					lease = current
+				}
+			}
+			switch {
+			case renewCtx.Err() != nil:
+				return
+			case apierrs.IsNotFound(err):
+				lost = true
+			case time.Since(renewed) > duration:
+				err, lost = fmt.Errorf("lease was not renewed for %s: %w", duration, err), true
+			}
+			if !lost {
+				logging.FromContext(ctx).Warnf("failed to renew lease %s/%s: %v", lease.Namespace, lease.Name, err)
+				continue
+			}
+			logging.FromContext(ctx).Errorf("lost lease %s/%s: %v", lease.Namespace, lease.Name, err)
+			lose()
+			return
+		}
+	}()
+	return heldCtx, func() {
+		cancel()
+		<-done
+		lose()
+		if lost {
+			return
+		}
+		// Only delete the lease if it was not taken over in the meantime.
+		err := leases.Delete(context.WithoutCancel(ctx), lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil && !apierrs.IsNotFound(err) {
+			logging.FromContext(ctx).Warnf("failed to release lease %s/%s: %v", lease.Namespace, lease.Name, err)
+		}
+	}
+}
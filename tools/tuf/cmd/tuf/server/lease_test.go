@@ -0,0 +1,325 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sigstore/scaffolding/tools/secret/pkg/secret"
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAcquireLease(t *testing.T) {
+	defer func(interval time.Duration) { leasePollInterval = interval }(leasePollInterval)
+	leasePollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+	clientset := fake.NewClientset()
+
+	_, releaseA, err := acquireLease(ctx, clientset, "tuf-system", "tuf-root-init", "a", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	acquiredB := make(chan func())
+	go func() {
+		_, releaseB, err := acquireLease(ctx, clientset, "tuf-system", "tuf-root-init", "b", time.Minute)
+		if err != nil {
+			t.Errorf("Failed to acquire lease: %v", err)
+		}
+		acquiredB <- releaseB
+	}()
+	select {
+	case <-acquiredB:
+		t.Fatal("lease was acquired while it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseA()
+	select {
+	case releaseB := <-acquiredB:
+		releaseB()
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease was not acquired after it was released")
+	}
+	if _, err := clientset.CoordinationV1().Leases("tuf-system").Get(ctx, "tuf-root-init", metav1.GetOptions{}); !apierrs.IsNotFound(err) {
+		t.Errorf("expected the released lease to be deleted, got %v", err)
+	}
+
+	// A lease that was not renewed in time is taken over.
+	holder, seconds, renewed := "crashed", int32(60), metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	if _, err := clientset.CoordinationV1().Leases("tuf-system").Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tuf-system", Name: "tuf-root-init"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &seconds, RenewTime: &renewed},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create lease: %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, releaseC, err := acquireLease(timeoutCtx, clientset, "tuf-system", "tuf-root-init", "c", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to take over expired lease: %v", err)
+	}
+	lease, err := clientset.CoordinationV1().Leases("tuf-system").Get(ctx, "tuf-root-init", metav1.GetOptions{})
+	if err != nil || *lease.Spec.HolderIdentity != "c" {
+		t.Errorf("expected the lease to be held by c, got %v, %v", lease, err)
+	}
+	releaseC()
+}
+
+func TestLeaseLost(t *testing.T) {
+	ctx := context.Background()
+	for name, tc := range map[string]struct {
+		takeOver bool
+		// err is returned for the renewals of the lease once it is lost.
+		err error
+	}{
+		// Like the API server, the renewals of a lease that was taken over
+		// conflict.
+		"taken over":  {takeOver: true, err: apierrs.NewConflict(coordinationv1.Resource("leases"), "tuf-root-refresh", errors.New("the lease was modified"))},
+		"not renewed": {err: errors.New("unavailable")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewClientset()
+			var lost atomic.Bool
+			clientset.PrependReactor("update", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return lost.Load(), nil, tc.err
+			})
+			heldCtx, release, err := acquireLease(ctx, clientset, "tuf-system", "tuf-root-refresh", "a", 300*time.Millisecond)
+			if err != nil {
+				t.Fatalf("Failed to acquire lease: %v", err)
+			}
+			if tc.takeOver {
+				leases := clientset.CoordinationV1().Leases("tuf-system")
+				lease, err := leases.Get(ctx, "tuf-root-refresh", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("Failed to get lease: %v", err)
+				}
+				other := "b"
+				lease.Spec.HolderIdentity = &other
+				if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+					t.Fatalf("Failed to take over lease: %v", err)
+				}
+			}
+			lost.Store(true)
+			select {
+			case <-heldCtx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the context of the holder to be canceled once the lease was lost")
+			}
+			// A lost lease is left to its new holder, or to expire.
+			release()
+			if _, err := clientset.CoordinationV1().Leases("tuf-system").Get(ctx, "tuf-root-refresh", metav1.GetOptions{}); err != nil {
+				t.Errorf("expected the lost lease not to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCoordinateInit(t *testing.T) {
+	defer func(interval time.Duration) { leasePollInterval = interval }(leasePollInterval)
+	leasePollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+	clientset := fake.NewClientset()
+	nsSecret := clientset.CoreV1().Secrets("tuf-system")
+	var inits atomic.Int32
+	coordinate := func(holder, inputs string, needsRefresher bool) ([]byte, error) {
+		return coordinateInit(ctx, clientset, "tuf-system", "tuf-root", holder, inputs, needsRefresher, func() error {
+			inits.Add(1)
+			// Give other replicas time to wait for the lease.
+			time.Sleep(100 * time.Millisecond)
+			return secret.ReconcileSecret(ctx, "tuf-root", "tuf-system", map[string][]byte{"repository": []byte(holder)}, nsSecret)
+		})
+	}
+
+	// Two replicas start at the same time, only one of them creates a
+	// repository and the other one adopts it.
+	results := make([][]byte, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			holder := fmt.Sprintf("replica-%d", i)
+			adopted, err := coordinate(holder, "files", false)
+			if err != nil {
+				t.Errorf("%s failed to coordinateInit: %v", holder, err)
+			}
+			results[i] = adopted
+		}()
+	}
+	wg.Wait()
+	if n := inits.Load(); n != 1 {
+		t.Fatalf("expected the repository to be initialized once, got %d", n)
+	}
+	s, err := nsSecret.Get(ctx, "tuf-root", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get secret: %v", err)
+	}
+	if got := string(s.Data[initInputsKey]); got != "files" {
+		t.Errorf("expected the inputs to be stored, got %q", got)
+	}
+	if results[0] == nil == (results[1] == nil) {
+		t.Fatalf("expected exactly one replica to adopt the repository, got %q and %q", results[0], results[1])
+	}
+	stored := s.Data["repository"]
+
+	for _, tc := range []struct {
+		name           string
+		inputs         string
+		needsRefresher bool
+		refresher      bool
+		adopt          bool
+	}{
+		// Replicas starting later adopt the repository as well.
+		{name: "same inputs", inputs: "files", adopt: true},
+		{name: "kept fresh", inputs: "files", needsRefresher: true, refresher: true, adopt: true},
+		// Other inputs replace the repository.
+		{name: "other inputs", inputs: "other files"},
+		// Without its keys, a repository no one keeps fresh is replaced.
+		{name: "not kept fresh", inputs: "other files", needsRefresher: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.refresher {
+				_, release, err := acquireLease(ctx, clientset, "tuf-system", "tuf-root-refresh", "replica-0", time.Minute)
+				if err != nil {
+					t.Fatalf("Failed to acquire lease: %v", err)
+				}
+				defer release()
+			}
+			before := inits.Load()
+			adopted, err := coordinate("replica-2", tc.inputs, tc.needsRefresher)
+			if err != nil {
+				t.Fatalf("Failed to coordinateInit: %v", err)
+			}
+			if tc.adopt != (adopted != nil) || tc.adopt == (inits.Load() != before) {
+				t.Fatalf("expected adopting the repository to be %t, got %q after %d inits", tc.adopt, adopted, inits.Load()-before)
+			}
+			if tc.adopt && !bytes.Equal(adopted, stored) {
+				t.Errorf("expected %q to be adopted, got %q", stored, adopted)
+			}
+			s, err := nsSecret.Get(ctx, "tuf-root", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Failed to get secret: %v", err)
+			}
+			stored = s.Data["repository"]
+			if got := string(s.Data[initInputsKey]); got != tc.inputs {
+				t.Errorf("expected inputs %q to be stored, got %q", tc.inputs, got)
+			}
+		})
+	}
+}
+
+func TestRefreshTUFRepoWithLease(t *testing.T) {
+	defer func(interval time.Duration) { leasePollInterval = interval }(leasePollInterval)
+	leasePollInterval = 10 * time.Millisecond
+	defer func(interval time.Duration) { *refreshInterval = interval }(*refreshInterval)
+	*refreshInterval = 20 * time.Millisecond
+	clientset := fake.NewClientset()
+	defer func(f func() (kubernetes.Interface, error)) { newClientset = f }(newClientset)
+	newClientset = func() (kubernetes.Interface, error) { return clientset, nil }
+	t.Setenv("NAMESPACE", "tuf-system")
+	ctx := context.Background()
+
+	local, dir, err := repo.CreateRepoWithOptions(ctx, map[string][]byte{"rekor.pub": []byte("rekor")}, repo.CreateRepoOptions{AddMetadataTargets: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := repoDefinition{targetDir: t.TempDir(), repoSecretName: "tuf-root", keysSecretName: "tuf-keys", roles: roleOptions()}
+	if err := publishTUFRepo(ctx, local, dir, d.targetDir, d.repoSecretName, d.keysSecretName); err != nil {
+		t.Fatalf("Failed to publishTUFRepo: %v", err)
+	}
+	if err := removeOfflineKeys(dir); err != nil {
+		t.Fatalf("Failed to removeOfflineKeys: %v", err)
+	}
+	timestampVersion := func() int64 {
+		t.Helper()
+		s, err := clientset.CoreV1().Secrets("tuf-system").Get(ctx, "tuf-root", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get secret: %v", err)
+		}
+		fsys, err := repo.UncompressFS(bytes.NewReader(s.Data["repository"]))
+		if err != nil {
+			t.Fatalf("Failed to uncompress repository: %v", err)
+		}
+		repoFS, err := fs.Sub(fsys, "repository")
+		if err != nil {
+			t.Fatalf("Failed to get repository directory: %v", err)
+		}
+		_, version, err := repoVersions(repoFS)
+		if err != nil {
+			t.Fatalf("Failed to read versions: %v", err)
+		}
+		return version
+	}
+	holder := func() string {
+		t.Helper()
+		lease, err := clientset.CoordinationV1().Leases("tuf-system").Get(ctx, "tuf-root-refresh", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get lease: %v", err)
+		}
+		return *lease.Spec.HolderIdentity
+	}
+	refresh := func(ctx context.Context, name, workDir string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			refreshTUFRepoWithLease(ctx, clientset, "tuf-system", name, d, workDir)
+		}()
+		return done
+	}
+
+	// The replica that created the repository refreshes it with its keys,
+	// while another one waits for the lease.
+	ctxA, cancelA := context.WithCancel(ctx)
+	defer cancelA()
+	doneA := refresh(ctxA, "a", dir)
+	eventually(t, "a to refresh the repository", func() bool { return timestampVersion() >= 3 })
+	ctxB, cancelB := context.WithCancel(ctx)
+	defer cancelB()
+	doneB := refresh(ctxB, "b", "")
+	time.Sleep(100 * time.Millisecond)
+	if got := holder(); got != "a" {
+		t.Fatalf("expected a to hold the refresh lease, got %s", got)
+	}
+
+	// Once a stops, b takes over with the keys of the secrets.
+	cancelA()
+	<-doneA
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected the working directory with the keys of a to be removed, got %v", err)
+	}
+	version := timestampVersion()
+	eventually(t, "b to refresh the repository", func() bool { return timestampVersion() >= version+2 })
+	if got := holder(); got != "b" {
+		t.Errorf("expected b to hold the refresh lease, got %s", got)
+	}
+	cancelB()
+	<-doneB
+}
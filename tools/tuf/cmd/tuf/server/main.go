@@ -17,21 +17,43 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/sigstore/scaffolding/tools/secret/pkg/secret"
 	"github.com/sigstore/scaffolding/tools/tuf/pkg/certs"
 	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/signals"
 	"sigs.k8s.io/release-utils/version"
+	"sigs.k8s.io/yaml"
+
+	// The KMS providers of the --root-signer and --targets-signer flags.
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/aws"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/azure"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/gcp"
+	_ "github.com/sigstore/sigstore/pkg/signature/kms/hashivault"
 )
 
 const (
@@ -39,14 +61,23 @@ const (
 	modeInitAndServe    = "init-and-serve"
 	modeServe           = "serve"
 	modeInitNoOverwrite = "init-no-overwrite"
+	modeRotateRoot      = "rotate-root"
+	modeUpdate          = "update"
+	// The two phases of a signing ceremony with offline root and targets
+	// keys.
+	modeExportUnsigned   = "export-unsigned"
+	modeImportSignatures = "import-signatures"
+	// Serves the repository of --rootsecret from memory, without a target
+	// directory.
+	modeServeSecret = "serve-secret"
 )
 
 var (
-	dir       = flag.String("file-dir", "/var/run/tuf-secrets", "Directory where all the files that need to be added to TUF root live. File names are used to as targets.")
+	dir       = flag.String("file-dir", "/var/run/tuf-secrets", "Directory where all the files that need to be added to TUF root live. File names are used to as targets. An optional manifest.yaml or manifest.json describes the usage of the files instead of their names.")
 	targetDir = flag.String("target-dir", "", "Directory where TUF repository should be created/served from. Defaults to temporary directory.")
-	mode      = flag.String("mode", modeInitAndServe, "Run mode of the TUF server. One of: init, init-and-serve, serve, init-no-overwrite")
+	mode      = flag.String("mode", modeInitAndServe, "Run mode of the TUF server. One of: init, init-and-serve, serve, serve-secret, init-no-overwrite, rotate-root, update, export-unsigned, import-signatures")
 	// Name of the "secret" where we create two entries, one for:
-	// root = Which holds 1.root.json
+	// root = Which holds the current root.json
 	// repository - Compressed repo, which has been tar/gzipped.
 	secretName = flag.String("rootsecret", "tuf-root", "Name of the secret to create for the initial root file")
 	// Name of the "secret" where we create one entry per key JSON definition as generated by TUF, e.g. "root.json", "timestamp.json", ...
@@ -55,45 +86,232 @@ var (
 	metadataTargets = flag.Bool("metadata-targets", true, "Serve individual targets with custom Sigstore metadata. This will be deprecated and removed in the future.")
 	trustedRoot     = flag.Bool("trusted-root", true, "Generate and serve trusted_root.json")
 	signingConfig   = flag.Bool("signing-config", true, "Generate and serve signing_config.v0.2.json")
+	roleFlags       = registerRoleFlags()
+	serviceFlags    = registerServiceFlags()
+	refreshInterval = flag.Duration("refresh-interval", 24*time.Hour, "How often snapshot and timestamp metadata are re-signed while serving. Requires the keys from init, or --keyssecret in serve mode. Set to 0 to disable.")
+	ceremonyDir     = flag.String("ceremony-dir", "", "Directory of a signing ceremony with offline keys. export-unsigned reads the public keys of the offline roles from offline-keys/<role>.json and writes the payloads to sign to payloads/<role>.json, import-signatures reads the signatures from signatures/<role>.json. The repository is kept in repo/ in between.")
+	gracePeriod     = flag.Duration("grace-period", 10*time.Minute, "How long a replaced version of the repository is kept in --target-dir, so clients in the middle of an update can finish it.")
+	reuseKeys       = flag.Bool("reuse-keys", true, "In init modes, if --keyssecret and --rootsecret already hold a repository and its keys, e.g. after a restart, update that repository with the files in --file-dir instead of creating one with new keys, so that clients keep trusting it. Init used to always create a new root, set to false to keep doing that.")
+	initLeaseTTL    = flag.Duration("init-lease-duration", 2*time.Minute, "How long the leases that keep replicas from initializing or refreshing the repository at the same time are valid for without being renewed, e.g. after their holder crashed.")
+	listenAddress   = flag.String("listen-address", ":8080", "Address to serve the TUF repository on, along with /healthz, /readyz (which fails once the served timestamp.json expired) and Prometheus /metrics.")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "In serve modes, how long requests in flight are given to finish once the server is asked to stop. Keep it below the termination grace period of the pod.")
+	tlsCert         = flag.String("tls-cert", "", "Path of the PEM certificate (chain) to serve the TUF repository with over HTTPS instead of HTTP. Requires --tls-key.")
+	tlsKey          = flag.String("tls-key", "", "Path of the PEM private key of --tls-cert.")
+	repoDefsFile    = flag.String("repositories", "", "Path of a YAML or JSON file listing several TUF repositories to manage and serve instead of the one configured with --file-dir, --rootsecret and --keyssecret. Each repository has a name, which it is served under as a path prefix and published under in --target-dir, a fileDir, and optionally a rootSecret and keysSecret (defaulting to --rootsecret and --keyssecret suffixed with -<name>), metadataTargets, trustedRoot and signingConfig, per-role keys, threshold and expires, per-service url, origin, apiVersion, operator, selector and count like the --<service>-* flags, and delegations like --delegations. Unset options default to the flags. The names healthz, readyz, metrics and index.json are reserved. /index.json lists the repositories with the digests of their roots. Only used in init, serve and serve-secret modes.")
+	delegationsFile = flag.String("delegations", "", "Path of a YAML or JSON file listing delegated targets roles, each with a name, the paths (glob patterns) of the targets it signs instead of the targets role, and optionally the number of keys, threshold and expiration (e.g. 4380h) of the role. Only used in init and update, where update requires the delegations the repository was created with.")
 )
 
-func getNamespaceAndClientset(noK8s bool) (string, *kubernetes.Clientset, error) {
-	if noK8s {
-		return "", nil, nil
+// signerPasswordEnv is the environment variable holding the password of the
+// encrypted private keys given with --<role>-signer.
+const signerPasswordEnv = "TUF_SIGNER_PASSWORD"
+
+// roleFlag holds the flags configuring a single top-level TUF role. Flags
+// that don't apply to the role are nil.
+type roleFlag struct {
+	expires   *time.Duration
+	keys      *int
+	threshold *int
+	signer    *string
+}
+
+// registerRoleFlags registers --<role>-expires, --<role>-keys and
+// --<role>-threshold for all the top-level TUF roles, and --<role>-signer for
+// the roles that can sign with an external signer.
+func registerRoleFlags() map[string]roleFlag {
+	flags := map[string]roleFlag{}
+	for _, role := range repo.TopLevelRoles {
+		f := roleFlag{
+			expires:   flag.Duration(role+"-expires", 0, fmt.Sprintf("How long %s metadata is valid for. Defaults to 6 months.", role)),
+			keys:      flag.Int(role+"-keys", 0, fmt.Sprintf("Number of keys to generate for the %s role. Defaults to 1, or to the current number of keys when rotating root.", role)),
+			threshold: flag.Int(role+"-threshold", 0, fmt.Sprintf("Number of signatures required for the %s role. Defaults to 1, or to the current threshold when rotating root.", role)),
+		}
+		if slices.Contains(repo.SignerRoles, role) {
+			f.signer = flag.String(role+"-signer", "", fmt.Sprintf("KMS URI (awskms://, azurekms://, gcpkms:// or hashivault://) or path of an encrypted private key to sign the %s role with, instead of a generated key that is stored in --keyssecret. Other KMS URIs like <scheme>://... need the sigstore KMS plugin sigstore-kms-<scheme> on $PATH. The password of the private key is read from $%s.", role, signerPasswordEnv))
+		}
+		flags[role] = f
 	}
+	return flags
+}
 
-	ns := os.Getenv("NAMESPACE")
-	if ns == "" {
-		panic("env variable NAMESPACE must be set")
+// roleSigners holds the signers loaded with loadRoleSigners.
+var roleSigners = map[string]signature.SignerVerifier{}
+
+// loadRoleSigners loads the signers configured with --<role>-signer.
+func loadRoleSigners(ctx context.Context) error {
+	pf := cryptoutils.StaticPasswordFunc([]byte(os.Getenv(signerPasswordEnv)))
+	for role, f := range roleFlags {
+		if f.signer == nil || *f.signer == "" {
+			continue
+		}
+		sv, err := repo.LoadSigner(ctx, *f.signer, pf)
+		if err != nil {
+			return fmt.Errorf("failed to load %s signer: %w", role, err)
+		}
+		logging.FromContext(ctx).Infof("Signing %s with %s", role, *f.signer)
+		roleSigners[role] = sv
+	}
+	return nil
+}
+
+// roleOptions returns the role options configured with the role flags.
+func roleOptions() map[string]repo.RoleOptions {
+	roles := map[string]repo.RoleOptions{}
+	for role, f := range roleFlags {
+		roles[role] = repo.RoleOptions{Expires: *f.expires, Keys: *f.keys, Threshold: *f.threshold, Signer: roleSigners[role]}
+	}
+	return roles
+}
+
+// delegationConfig is a delegated targets role in the file given with
+// --delegations.
+type delegationConfig struct {
+	Name      string          `json:"name"`
+	Paths     []string        `json:"paths"`
+	Keys      int             `json:"keys,omitempty"`
+	Threshold int             `json:"threshold,omitempty"`
+	Expires   metav1.Duration `json:"expires,omitempty"`
+}
+
+// delegations holds the delegations loaded with loadDelegations.
+var delegations []repo.Delegation
+
+// loadDelegations loads the delegations configured with --delegations.
+func loadDelegations(ctx context.Context) error {
+	if *delegationsFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*delegationsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read delegations: %w", err)
+	}
+	configs := []delegationConfig{}
+	if err := yaml.UnmarshalStrict(b, &configs); err != nil {
+		return fmt.Errorf("failed to parse delegations %s: %w", *delegationsFile, err)
+	}
+	delegations = toDelegations(ctx, configs)
+	return nil
+}
+
+// toDelegations returns the delegations configured with configs.
+func toDelegations(ctx context.Context, configs []delegationConfig) []repo.Delegation {
+	var result []repo.Delegation
+	for _, c := range configs {
+		logging.FromContext(ctx).Infof("Delegating %s to role %s", strings.Join(c.Paths, ", "), c.Name)
+		result = append(result, repo.Delegation{
+			Name:        c.Name,
+			Paths:       c.Paths,
+			RoleOptions: repo.RoleOptions{Expires: c.Expires.Duration, Keys: c.Keys, Threshold: c.Threshold},
+		})
+	}
+	return result
+}
+
+// serviceFlag holds the flags configuring a single service. Flags that don't
+// apply to the service are nil.
+type serviceFlag struct {
+	url        *string
+	origin     *string
+	apiVersion *uint
+	operator   *string
+	selector   *string
+	count      *uint
+}
+
+// registerServiceFlags registers --<service>-url for all the services in
+// trusted_root.json and signing_config, --<service>-api-version and
+// --<service>-operator for the ones in signing_config, --<service>-origin for
+// the transparency logs and --<service>-selector and --<service>-count for
+// Rekor and the TSA.
+func registerServiceFlags() map[string]serviceFlag {
+	flags := map[string]serviceFlag{}
+	for _, name := range repo.ServiceNames {
+		f := serviceFlag{
+			url: flag.String(name+"-url", "", fmt.Sprintf("Base URL of the %s service. Defaults to the %s service deployed by scaffolding.", name, name)),
+		}
+		if name != "ctlog" {
+			f.apiVersion = flag.Uint(name+"-api-version", 0, fmt.Sprintf("Major API version of the %s service in signing_config.", name))
+			f.operator = flag.String(name+"-operator", "", fmt.Sprintf("Operator of the %s service in signing_config. Defaults to test.", name))
+		}
+		if name == "rekor" || name == "ctlog" {
+			f.origin = flag.String(name+"-origin", "", fmt.Sprintf("Origin of the %s log used to compute its log ID. Defaults to the host of --%s-url.", name, name))
+		}
+		if name == "rekor" || name == "tsa" {
+			f.selector = flag.String(name+"-selector", "", fmt.Sprintf("Selector for the %s services in signing_config. One of: ANY, ALL, EXACT. Defaults to ANY.", name))
+			f.count = flag.Uint(name+"-count", 0, fmt.Sprintf("Number of %s services to use with --%s-selector=EXACT.", name, name))
+		}
+		flags[name] = f
 	}
+	return flags
+}
+
+// serviceOptions returns the services configured with the service flags.
+func serviceOptions() map[string]repo.Service {
+	services := map[string]repo.Service{}
+	for name, f := range serviceFlags {
+		service := repo.Service{URL: *f.url}
+		if f.origin != nil {
+			service.Origin = *f.origin
+		}
+		if f.apiVersion != nil {
+			/* #nosec G115 */
+			service.APIVersion = uint32(*f.apiVersion)
+		}
+		if f.operator != nil {
+			service.Operator = *f.operator
+		}
+		if f.selector != nil {
+			service.Selector = *f.selector
+			/* #nosec G115 */
+			service.Count = uint32(*f.count)
+		}
+		services[name] = service
+	}
+	return services
+}
 
+// newClientset returns the clientset of the cluster the server runs in. It
+// is replaced with a fake one in tests.
+var newClientset = func() (kubernetes.Interface, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get InClusterConfig: %w", err)
+		return nil, fmt.Errorf("failed to get InClusterConfig: %w", err)
 	}
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get clientset: %w", err)
+		return nil, fmt.Errorf("failed to get clientset: %w", err)
 	}
-
-	return ns, clientset, nil
+	return clientset, nil
 }
 
-func initTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysSecretName string) error {
-	versionInfo := version.GetVersionInfo()
-	logging.FromContext(ctx).Infof("running create_repo Version: %s GitCommit: %s BuildDate: %s", versionInfo.GitVersion, versionInfo.GitCommit, versionInfo.BuildDate)
+func getNamespaceAndClientset(noK8s bool) (string, kubernetes.Interface, error) {
+	if noK8s {
+		return "", nil, nil
+	}
 
-	ns, clientset, err := getNamespaceAndClientset(*noK8s)
+	ns := os.Getenv("NAMESPACE")
+	if ns == "" {
+		panic("env variable NAMESPACE must be set")
+	}
+
+	clientset, err := newClientset()
 	if err != nil {
-		return fmt.Errorf("failed to get namespace and clientset: %w", err)
+		return "", nil, err
 	}
 
+	return ns, clientset, nil
+}
+
+// readTUFFiles reads the files in certsDir that should be added as targets
+// to the TUF repository. If certsDir contains a manifest, it is returned as
+// well and describes the files instead of their names.
+func readTUFFiles(ctx context.Context, certsDir string) (map[string][]byte, *repo.Manifest, error) {
 	trimDir := strings.TrimSuffix(certsDir, "/")
 	tufFiles, err := os.ReadDir(trimDir)
 	if err != nil {
-		return fmt.Errorf("failed to read dir %s: %w", trimDir, err)
+		return nil, nil, fmt.Errorf("failed to read dir %s: %w", trimDir, err)
 	}
 	files := map[string][]byte{}
+	var manifest *repo.Manifest
 	for _, file := range tufFiles {
 		if !file.IsDir() {
 			logging.FromContext(ctx).Infof("Got file %s", file.Name())
@@ -106,32 +324,564 @@ func initTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysS
 			fileName := fmt.Sprintf("%s/%s", trimDir, file.Name())
 			fileBytes, err := os.ReadFile(fileName)
 			if err != nil {
-				return fmt.Errorf("failed to read file %s: %w", fileName, err)
+				return nil, nil, fmt.Errorf("failed to read file %s: %w", fileName, err)
 			}
-			// If it's a TSA file, we need to split it into multiple TUF
-			// targets.
-			if strings.Contains(file.Name(), "tsa") {
-				logging.FromContext(ctx).Infof("Splitting TSA certchain into individual certs")
-
-				certFiles, err := certs.SplitCertChain(fileBytes, "tsa")
-				if err != nil {
-					return fmt.Errorf("failed to parse %s: %w", fileName, err)
+			if slices.Contains(repo.ManifestFileNames, file.Name()) {
+				if manifest != nil {
+					return nil, nil, fmt.Errorf("found more than one manifest in %s", trimDir)
 				}
-				for k, v := range certFiles {
-					logging.FromContext(ctx).Infof("Got tsa cert file %s", k)
-					trimmedCert := strings.TrimSpace(string(v))
-					files[k] = []byte(trimmedCert)
+				logging.FromContext(ctx).Infof("Using manifest %s", file.Name())
+				if manifest, err = repo.ParseManifest(fileBytes); err != nil {
+					return nil, nil, fmt.Errorf("failed to parse %s: %w", fileName, err)
 				}
-			} else {
-				files[file.Name()] = fileBytes
+				continue
+			}
+			files[file.Name()] = fileBytes
+		}
+	}
+
+	if manifest != nil {
+		if err := splitManifestCertChains(ctx, files, manifest); err != nil {
+			return nil, nil, err
+		}
+		return files, manifest, nil
+	}
+	tsaFiles := 0
+	for name := range files {
+		if strings.Contains(name, "tsa") {
+			tsaFiles++
+		}
+	}
+	targets := map[string][]byte{}
+	for name, fileBytes := range files {
+		// If it's a TSA file, we need to split it into multiple TUF
+		// targets.
+		if strings.Contains(name, "tsa") {
+			logging.FromContext(ctx).Infof("Splitting TSA certchain into individual certs")
+
+			// With more than one TSA, name the certs after their chain so
+			// they don't overwrite each other.
+			prefix := "tsa"
+			if tsaFiles > 1 {
+				prefix = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			certFiles, err := certs.SplitCertChain(fileBytes, prefix)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+			for k, v := range certFiles {
+				logging.FromContext(ctx).Infof("Got tsa cert file %s", k)
+				trimmedCert := strings.TrimSpace(string(v))
+				targets[k] = []byte(trimmedCert)
 			}
+		} else {
+			targets[name] = fileBytes
+		}
+	}
+	return targets, nil, nil
+}
+
+// splitManifestCertChains splits the TSA files of the manifest that hold a
+// whole certificate chain into individual certs, replacing their manifest
+// entries with one for every cert.
+func splitManifestCertChains(ctx context.Context, files map[string][]byte, manifest *repo.Manifest) error {
+	targets := make([]repo.ManifestTarget, 0, len(manifest.Targets))
+	for _, t := range manifest.Targets {
+		fileBytes, ok := files[t.Name]
+		if !ok || t.Usage != repo.TSATarget || t.Certificate != "" || bytes.Count(fileBytes, []byte("-----BEGIN CERTIFICATE-----")) < 2 {
+			targets = append(targets, t)
+			continue
+		}
+		logging.FromContext(ctx).Infof("Splitting TSA certchain %s into individual certs", t.Name)
+		certFiles, err := certs.SplitCertChain(fileBytes, strings.TrimSuffix(t.Name, filepath.Ext(t.Name)))
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", t.Name, err)
+		}
+		delete(files, t.Name)
+		for k, v := range certFiles {
+			logging.FromContext(ctx).Infof("Got tsa cert file %s", k)
+			cert := t
+			cert.Name = k
+			switch {
+			case strings.HasSuffix(k, "_leaf.crt.pem"):
+				cert.Certificate = repo.LeafCertificate
+			case strings.HasSuffix(k, "_root.crt.pem"):
+				cert.Certificate = repo.RootCertificate
+			default:
+				cert.Certificate = repo.IntermediateCertificate
+			}
+			files[k] = []byte(strings.TrimSpace(string(v)))
+			targets = append(targets, cert)
+		}
+	}
+	manifest.Targets = targets
+	return nil
+}
+
+// createRepoOptions returns the options for creating the TUF repository as
+// configured with flags and the given manifest.
+func createRepoOptions(manifest *repo.Manifest) repo.CreateRepoOptions {
+	return repo.CreateRepoOptions{AddMetadataTargets: *metadataTargets, AddTrustedRoot: *trustedRoot, AddSigningConfig: *signingConfig, Manifest: manifest, Services: serviceOptions(), Roles: roleOptions(), Delegations: delegations}
+}
+
+// initTUFRepo creates a new TUF repository for files and manifest with the
+// options returned by options and publishes it, or updates the one stored in
+// the repository and keys secrets with --reuse-keys. The update keeps the
+// validity periods of the trusted root and signing config, so init with the
+// same files does not publish new targets. It returns the directory the
+// repository was created in, which also holds its keys.
+func initTUFRepo(ctx context.Context, files map[string][]byte, manifest *repo.Manifest, targetDir, repoSecretName, keysSecretName string, options func(*repo.Manifest) repo.CreateRepoOptions) (string, error) {
+	versionInfo := version.GetVersionInfo()
+	logging.FromContext(ctx).Infof("running create_repo Version: %s GitCommit: %s BuildDate: %s", versionInfo.GitVersion, versionInfo.GitCommit, versionInfo.BuildDate)
+
+	// Keep the root clients already trust if its keys were persisted.
+	if *reuseKeys && !*noK8s && keysSecretName != "" {
+		dir, err := loadTUFRepo(ctx, repoSecretName, keysSecretName)
+		switch {
+		case err == nil:
+			logging.FromContext(ctx).Infof("Reusing the repository and keys of secrets %s and %s", repoSecretName, keysSecretName)
+			return dir, updateLoadedTUFRepo(ctx, dir, files, manifest, targetDir, repoSecretName, keysSecretName, options)
+		case !apierrs.IsNotFound(err):
+			return "", fmt.Errorf("failed to load repo: %w", err)
 		}
 	}
 
 	// Create a new TUF root with the listed artifacts.
-	local, dir, err := repo.CreateRepoWithOptions(ctx, files, repo.CreateRepoOptions{AddMetadataTargets: *metadataTargets, AddTrustedRoot: *trustedRoot, AddSigningConfig: *signingConfig})
+	local, dir, err := repo.CreateRepoWithOptions(ctx, files, options(manifest))
+	if err != nil {
+		return "", fmt.Errorf("failed to create repo: %w", err)
+	}
+
+	return dir, publishTUFRepo(ctx, local, dir, targetDir, repoSecretName, keysSecretName)
+}
+
+// initOrAdoptTUFRepo creates a new TUF repository from the files in
+// certsDir and publishes it like initTUFRepo, unless another replica already
+// stored one created from the same files in the repository secret. That
+// repository is published to targetDir instead, and the returned directory
+// is empty as its keys were not loaded.
+func initOrAdoptTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysSecretName string, options func(*repo.Manifest) repo.CreateRepoOptions) (string, error) {
+	files, manifest, err := readTUFFiles(ctx, certsDir)
+	if err != nil {
+		return "", err
+	}
+	if *noK8s {
+		return initTUFRepo(ctx, files, manifest, targetDir, repoSecretName, keysSecretName, options)
+	}
+	ns, clientset, err := getNamespaceAndClientset(*noK8s)
+	if err != nil {
+		return "", fmt.Errorf("failed to get namespace and clientset: %w", err)
+	}
+	holder, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	inputs, err := initInputs(files, manifest)
+	if err != nil {
+		return "", err
+	}
+	// Without stored keys, only the replica that created the repository can
+	// keep its metadata fresh.
+	needsRefresher := keysSecretName == "" && *refreshInterval > 0
+	dir := ""
+	repository, err := coordinateInit(ctx, clientset, ns, repoSecretName, holder, inputs, needsRefresher, func() error {
+		dir, err = initTUFRepo(ctx, files, manifest, targetDir, repoSecretName, keysSecretName, options)
+		return err
+	})
+	if err != nil || repository == nil {
+		return dir, err
+	}
+	logging.FromContext(ctx).Infof("adopting the tuf repository of secret %s/%s", ns, repoSecretName)
+	return "", repo.Publish(ctx, repository, targetDir, *gracePeriod)
+}
+
+// initInputsKey is the key of the repository secret that holds the digest of
+// the files and manifest the repository was initialized from.
+const initInputsKey = "inputs"
+
+// initInputs returns the digest of the files and manifest a repository is
+// initialized from, which is stored in the repository secret.
+func initInputs(files map[string][]byte, manifest *repo.Manifest) (string, error) {
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(files[name]))
+		h.Write(files[name])
+	}
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	h.Write(m)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// coordinateInit runs init while holding the init lease of the repository
+// secret, so that replicas don't overwrite each other's repositories. If the
+// secret holds a repository that was initialized from the same inputs, init
+// is not run and that repository is returned instead, unless needsRefresher
+// is set and no replica holds the refresh lease of the repository, as no one
+// would keep it fresh then. After init, the inputs are stored in the secret.
+func coordinateInit(ctx context.Context, clientset kubernetes.Interface, ns, repoSecretName, holder, inputs string, needsRefresher bool, init func() error) ([]byte, error) {
+	nsSecret := clientset.CoreV1().Secrets(ns)
+	heldCtx, release, err := acquireLease(ctx, clientset, ns, repoSecretName+"-init", holder, *initLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	s, err := nsSecret.Get(ctx, repoSecretName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		repository, ok := s.Data["repository"]
+		if !ok || string(s.Data[initInputsKey]) != inputs {
+			break
+		}
+		if !needsRefresher {
+			return repository, nil
+		}
+		held, err := leaseHeld(ctx, clientset, ns, repoSecretName+"-refresh")
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			return repository, nil
+		}
+		logging.FromContext(ctx).Infof("no replica keeps the repository of secret %s/%s fresh, initializing it again", ns, repoSecretName)
+	case !apierrs.IsNotFound(err):
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", ns, repoSecretName, err)
+	}
+	if err := init(); err != nil {
+		return nil, err
+	}
+	// The inputs are only stored while the lease is held, so they don't
+	// overwrite the ones of a replica that took the lease over.
+	if err := secret.ReconcileSecret(heldCtx, repoSecretName, ns, map[string][]byte{initInputsKey: []byte(inputs)}, nsSecret); err != nil {
+		return nil, fmt.Errorf("failed to store the inputs of the repository: %w", err)
+	}
+	return nil, nil
+}
+
+// updateTUFRepo loads the TUF repository and its keys from the secrets
+// created by a previous init, updates its targets to match the files in
+// certsDir and publishes the resulting repository the same way init does.
+func updateTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysSecretName string) error {
+	files, manifest, err := readTUFFiles(ctx, certsDir)
+	if err != nil {
+		return err
+	}
+	dir, err := loadTUFRepo(ctx, repoSecretName, keysSecretName)
+	if err != nil {
+		return fmt.Errorf("failed to load repo: %w", err)
+	}
+	return updateLoadedTUFRepo(ctx, dir, files, manifest, targetDir, repoSecretName, keysSecretName, createRepoOptions)
+}
+
+// updateLoadedTUFRepo updates the targets of the TUF repository loaded into
+// dir by loadTUFRepo to match files, signing new versions with the existing
+// keys and the options returned by options, and publishes it the same way
+// init does.
+func updateLoadedTUFRepo(ctx context.Context, dir string, files map[string][]byte, manifest *repo.Manifest, targetDir, repoSecretName, keysSecretName string, options func(*repo.Manifest) repo.CreateRepoOptions) error {
+	local, err := repo.UpdateRepoWithOptions(ctx, dir, files, options(manifest))
+	if err != nil {
+		return fmt.Errorf("failed to update repo: %w", err)
+	}
+
+	return publishTUFRepo(ctx, local, dir, targetDir, repoSecretName, keysSecretName)
+}
+
+// loadTUFRepo recreates the working directory of the TUF repository stored in
+// the repository and keys secrets by a previous init. If keyFiles are given,
+// only those keys are loaded.
+func loadTUFRepo(ctx context.Context, repoSecretName, keysSecretName string, keyFiles ...string) (string, error) {
+	if *noK8s || keysSecretName == "" {
+		return "", errors.New("loading an existing repository requires the keys to be stored in a secret, set --keyssecret and do not use --no-k8s")
+	}
+	ns, clientset, err := getNamespaceAndClientset(*noK8s)
+	if err != nil {
+		return "", fmt.Errorf("failed to get namespace and clientset: %w", err)
+	}
+	nsSecret := clientset.CoreV1().Secrets(ns)
+
+	repoSecret, err := nsSecret.Get(ctx, repoSecretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s/%s: %w", ns, repoSecretName, err)
+	}
+	repository, ok := repoSecret.Data["repository"]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s does not contain a repository", ns, repoSecretName)
+	}
+	keysSecret, err := nsSecret.Get(ctx, keysSecretName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to create repo: %w", err)
+		return "", fmt.Errorf("failed to get secret %s/%s: %w", ns, keysSecretName, err)
+	}
+	keys := keysSecret.Data
+	if len(keyFiles) > 0 {
+		keys = map[string][]byte{}
+		for _, name := range keyFiles {
+			if content, ok := keysSecret.Data[name]; ok {
+				keys[name] = content
+			}
+		}
+	}
+
+	return repo.LoadRepo(ctx, repository, keys)
+}
+
+// rotateTUFRoot loads the TUF repository and its keys from the secrets
+// created by a previous init, replaces the root keys and publishes the
+// resulting repository the same way init does.
+func rotateTUFRoot(ctx context.Context, targetDir, repoSecretName, keysSecretName string) error {
+	dir, err := loadTUFRepo(ctx, repoSecretName, keysSecretName)
+	if err != nil {
+		return fmt.Errorf("failed to load repo: %w", err)
+	}
+	local, err := repo.RotateRoot(ctx, dir, roleOptions())
+	if err != nil {
+		return fmt.Errorf("failed to rotate root: %w", err)
+	}
+
+	return publishTUFRepo(ctx, local, dir, targetDir, repoSecretName, keysSecretName)
+}
+
+// exportUnsignedTUFRepo creates a new TUF repository in the ceremony
+// directory whose root and targets metadata are signed offline, and writes
+// the payloads to sign.
+func exportUnsignedTUFRepo(ctx context.Context, certsDir, ceremonyDir string) error {
+	files, manifest, err := readTUFFiles(ctx, certsDir)
+	if err != nil {
+		return err
+	}
+	offlineKeys := map[string][]*metadata.Key{}
+	for _, role := range repo.OfflineRoles {
+		keysPath := filepath.Join(ceremonyDir, "offline-keys", role+".json")
+		b, err := os.ReadFile(keysPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", keysPath, err)
+		}
+		pks := []*metadata.Key{}
+		if err := json.Unmarshal(b, &pks); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", keysPath, err)
+		}
+		offlineKeys[role] = pks
+	}
+
+	payloads, err := repo.ExportUnsigned(ctx, filepath.Join(ceremonyDir, "repo"), files, offlineKeys, createRepoOptions(manifest))
+	if err != nil {
+		return fmt.Errorf("failed to export unsigned repo: %w", err)
+	}
+	payloadsDir := filepath.Join(ceremonyDir, "payloads")
+	if err := os.MkdirAll(payloadsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create payloads dir: %w", err)
+	}
+	for name, payload := range payloads {
+		/* #nosec G306 */
+		if err := os.WriteFile(filepath.Join(payloadsDir, name), payload, 0644); err != nil {
+			return fmt.Errorf("failed to write payload %s: %w", name, err)
+		}
+		logging.FromContext(ctx).Infof("Wrote payload to sign %s", filepath.Join(payloadsDir, name))
+	}
+	return nil
+}
+
+// importTUFSignatures adds the signatures made offline to the repository in
+// the ceremony directory, and commits and publishes it the same way init
+// does. Only the online keys end up in the keys secret.
+func importTUFSignatures(ctx context.Context, ceremonyDir, targetDir, repoSecretName, keysSecretName string) error {
+	signaturesDir := filepath.Join(ceremonyDir, "signatures")
+	entries, err := os.ReadDir(signaturesDir)
+	if err != nil {
+		return fmt.Errorf("failed to list signatures dir: %w", err)
+	}
+	signatures := map[string][]metadata.Signature{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(signaturesDir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read signatures %s: %w", e.Name(), err)
+		}
+		sigs := []metadata.Signature{}
+		if err := json.Unmarshal(b, &sigs); err != nil {
+			return fmt.Errorf("failed to parse signatures %s: %w", e.Name(), err)
+		}
+		signatures[e.Name()] = sigs
+	}
+
+	dir := filepath.Join(ceremonyDir, "repo")
+	local, err := repo.ImportSignatures(ctx, dir, signatures, roleOptions())
+	if err != nil {
+		return fmt.Errorf("failed to import signatures: %w", err)
+	}
+
+	return publishTUFRepo(ctx, local, dir, targetDir, repoSecretName, keysSecretName)
+}
+
+// refreshTUFRepo periodically re-signs the snapshot and timestamp metadata of
+// the TUF repository in dir with the given role options so that the served
+// metadata does not expire, and publishes the result, until ctx is done or
+// replaced returns true. The keys are not published again.
+func refreshTUFRepo(ctx context.Context, dir, targetDir, repoSecretName string, roles map[string]repo.RoleOptions, interval time.Duration, replaced func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if replaced != nil && replaced() {
+				return
+			}
+			local, err := repo.ResignOnlineRoles(ctx, dir, roles)
+			if err != nil {
+				logging.FromContext(ctx).Errorf("failed to re-sign tuf repository: %v", err)
+				continue
+			}
+			if err := publishTUFRepo(ctx, local, dir, targetDir, repoSecretName, ""); err != nil {
+				logging.FromContext(ctx).Errorf("failed to publish re-signed tuf repository: %v", err)
+			}
+		}
+	}
+}
+
+// refreshTUFRepoWithLease re-signs the repository of d like refreshTUFRepo,
+// but only while holder holds the refresh lease of the repository, so that a
+// single replica writes the repository secret. The other replicas wait for
+// the lease and take over once it is not renewed anymore. The keys in
+// workDir are used as long as the repository stored in the secret is the one
+// in workDir, otherwise the online keys are loaded from the secrets of d.
+func refreshTUFRepoWithLease(ctx context.Context, clientset kubernetes.Interface, ns, holder string, d repoDefinition, workDir string) {
+	nsSecret := clientset.CoreV1().Secrets(ns)
+	// stored returns whether the repository in the secret is the one in dir.
+	stored := func(dir string) bool {
+		if dir == "" {
+			return false
+		}
+		s, err := nsSecret.Get(ctx, d.repoSecretName, metav1.GetOptions{})
+		if err != nil {
+			logging.FromContext(ctx).Warnf("failed to get secret %s/%s: %v", ns, d.repoSecretName, err)
+			return false
+		}
+		compressed, err := compressTUFRepo(dir)
+		return err == nil && bytes.Equal(compressed, s.Data["repository"])
+	}
+	// The working directory holds the online keys, so it must not outlive
+	// the refresh.
+	defer func() {
+		if workDir != "" {
+			os.RemoveAll(workDir)
+		}
+	}()
+	for {
+		heldCtx, release, err := acquireLease(ctx, clientset, ns, d.repoSecretName+"-refresh", holder, *initLeaseTTL)
+		if err != nil {
+			return
+		}
+		if !stored(workDir) {
+			loaded, err := loadTUFRepo(ctx, d.repoSecretName, d.keysSecretName, repo.OnlineKeyFiles...)
+			if err != nil {
+				release()
+				logging.FromContext(ctx).Warnf("not refreshing tuf metadata of secret %s/%s: %v", ns, d.repoSecretName, err)
+				return
+			}
+			if workDir != "" {
+				os.RemoveAll(workDir)
+			}
+			workDir = loaded
+		}
+		logging.FromContext(ctx).Infof("re-signing snapshot and timestamp of secret %s/%s every %s", ns, d.repoSecretName, *refreshInterval)
+		// Refreshing stops once the lease is lost, the replica then waits for
+		// it again.
+		refreshTUFRepo(heldCtx, workDir, d.targetDir, d.repoSecretName, d.roles, *refreshInterval, func() bool {
+			if stored(workDir) {
+				return false
+			}
+			logging.FromContext(ctx).Infof("the repository of secret %s/%s was replaced, reloading it", ns, d.repoSecretName)
+			return true
+		})
+		release()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// removeOfflineKeys deletes all keys but the ones needed to re-sign the
+// snapshot and timestamp metadata from the working directory in dir.
+func removeOfflineKeys(dir string) error {
+	keyFiles, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		return fmt.Errorf("failed to list keys directory %w", err)
+	}
+	for _, keyFile := range keyFiles {
+		if slices.Contains(repo.OnlineKeyFiles, keyFile.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, "keys", keyFile.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", keyFile.Name(), err)
+		}
+	}
+	return nil
+}
+
+// keyRoles returns the roles of the repository with metadata meta, whose keys
+// are stored in the keys secret: the top-level roles and the roles delegated
+// by targets.
+func keyRoles(meta map[string]json.RawMessage) (map[string]bool, error) {
+	targets, err := metadata.Targets().FromBytes(meta["targets.json"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse targets.json: %w", err)
+	}
+	roles := map[string]bool{metadata.ROOT: true, metadata.TARGETS: true, metadata.SNAPSHOT: true, metadata.TIMESTAMP: true}
+	if targets.Signed.Delegations != nil {
+		for _, role := range targets.Signed.Delegations.Roles {
+			roles[role.Name] = true
+		}
+	}
+	return roles, nil
+}
+
+// pruneKeysSecret deletes the keys of the keys secret name in ns that are not
+// in dataKeys, e.g. of delegated roles that were removed. ReconcileSecret
+// leaves them in place.
+func pruneKeysSecret(ctx context.Context, name, ns string, dataKeys map[string][]byte, nsSecret v1.SecretInterface) error {
+	s, err := nsSecret.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get keys secret %s/%s: %w", ns, name, err)
+	}
+	pruned := false
+	for k := range s.Data {
+		if _, ok := dataKeys[k]; !ok && strings.HasSuffix(k, ".json") {
+			logging.FromContext(ctx).Infof("deleting unused key %q from secret %s/%s", k, ns, name)
+			delete(s.Data, k)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	if _, err := nsSecret.Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update keys secret %s/%s: %w", ns, name, err)
+	}
+	return nil
+}
+
+// publishTUFRepo verifies the TUF repository in dir with a TUF client, then
+// stores the root and the compressed repository in the repository secret,
+// the keys in the keys secret (if given) and publishes the repository in
+// targetDir.
+func publishTUFRepo(ctx context.Context, local repo.LocalStore, dir, targetDir, repoSecretName, keysSecretName string) error {
+	// Make sure clients can consume the repository before anything is
+	// published.
+	if err := repo.VerifyRepo(ctx, os.DirFS(dir)); err != nil {
+		return fmt.Errorf("failed to verify the repo: %w", err)
+	}
+
+	ns, clientset, err := getNamespaceAndClientset(*noK8s)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace and clientset: %w", err)
 	}
 
 	meta, err := local.GetMeta()
@@ -143,18 +893,17 @@ func initTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysS
 		return fmt.Errorf("getting root: %w", err)
 	}
 
-	// Add the initial 1.root.json to secrets.
+	// Add the current root.json to secrets, which is the initial 1.root.json
+	// until the root is rotated. Clients bootstrap their trust from it.
 	data := make(map[string][]byte)
 	data["root"] = rootJSON
 
 	// Then compress the root directory and put it into a secret
 	// Secrets have 1MiB and the repository as tested goes to about ~3k, so no
 	// worries here.
-	var compressed bytes.Buffer
-	if err := repo.CompressFS(os.DirFS(dir), &compressed, map[string]bool{"keys": true, "staged": true}); err != nil {
-		return fmt.Errorf("failed to compress the repo: %w", err)
+	if data["repository"], err = compressTUFRepo(dir); err != nil {
+		return err
 	}
-	data["repository"] = compressed.Bytes()
 
 	if !*noK8s {
 		nsSecret := clientset.CoreV1().Secrets(ns)
@@ -168,9 +917,13 @@ func initTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysS
 			if err != nil {
 				return fmt.Errorf("failed to list keys directory %w", err)
 			}
+			roles, err := keyRoles(meta)
+			if err != nil {
+				return err
+			}
 			dataKeys := map[string][]byte{}
 			for _, keyFile := range keyFiles {
-				if !strings.HasSuffix(keyFile.Name(), ".json") {
+				if role, ok := strings.CutSuffix(keyFile.Name(), ".json"); !ok || !roles[role] {
 					continue
 				}
 				keyFilePath := filepath.Join(dir, "keys", keyFile.Name())
@@ -183,14 +936,27 @@ func initTUFRepo(ctx context.Context, certsDir, targetDir, repoSecretName, keysS
 			if err := secret.ReconcileSecret(ctx, keysSecretName, ns, dataKeys, nsSecret); err != nil {
 				return fmt.Errorf("failed to reconcile keys secret %s/%s: %w", ns, keysSecretName, err)
 			}
+			if err := pruneKeysSecret(ctx, keysSecretName, ns, dataKeys, nsSecret); err != nil {
+				return err
+			}
 		}
 	}
 
 	logging.FromContext(ctx).Infof("tuf repository was created in: %s, moving to %s", dir, targetDir)
 
-	// Copy repository to the targetDir - until Go 1.23 which has os.CopyFS, we use
-	// a quick hack where we uncompress the compressed repository to the targetDir
-	return repo.Uncompress(bytes.NewReader(data["repository"]), targetDir)
+	// The repository may be served from targetDir while it is replaced, so it
+	// is switched in as a whole rather than overwritten file by file.
+	return repo.Publish(ctx, data["repository"], targetDir, *gracePeriod)
+}
+
+// compressTUFRepo compresses the TUF repository in dir the way it is stored
+// in the repository secret, without keys and staged metadata.
+func compressTUFRepo(dir string) ([]byte, error) {
+	var compressed bytes.Buffer
+	if err := repo.CompressFS(os.DirFS(dir), &compressed, map[string]bool{"keys": true, "staged": true}); err != nil {
+		return nil, fmt.Errorf("failed to compress the repo: %w", err)
+	}
+	return compressed.Bytes(), nil
 }
 
 func main() {
@@ -198,13 +964,29 @@ func main() {
 
 	ctx := signals.NewContext()
 
+	if err := loadRoleSigners(ctx); err != nil {
+		logging.FromContext(ctx).Fatalf("%v", err)
+	}
+	if err := loadDelegations(ctx); err != nil {
+		logging.FromContext(ctx).Fatalf("%v", err)
+	}
+
 	if *metadataTargets {
 		logging.FromContext(ctx).Warnf("Serving individual TUF targets with custom Sigstore metadata will be deprecated and removed in the future.")
 	}
 
 	serve := false
+	serveSecret := false
 	init := false
 	overwrite := true
+	rotate := false
+	update := false
+	exportUnsigned := false
+	importSignatures := false
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logging.FromContext(ctx).Fatalf("'tls-cert' and 'tls-key' must be specified together")
+	}
 
 	switch *mode {
 	case modeInit:
@@ -220,11 +1002,24 @@ func main() {
 			logging.FromContext(ctx).Fatalf("'targetDir' must be specified to use the 'serve' mode")
 		}
 		serve = true
+	case modeServeSecret:
+		if *noK8s {
+			logging.FromContext(ctx).Fatalf("'no-k8s' can't be used with the 'serve-secret' mode")
+		}
+		serveSecret = true
+	case modeRotateRoot:
+		rotate = true
+	case modeUpdate:
+		update = true
+	case modeExportUnsigned:
+		exportUnsigned = true
+	case modeImportSignatures:
+		importSignatures = true
 	default:
 		logging.FromContext(ctx).Fatalf("unknown mode %s", *mode)
 	}
 
-	if *targetDir == "" {
+	if *targetDir == "" && !serveSecret {
 		newTmpDir, err := os.MkdirTemp(os.TempDir(), "tuf-serve")
 		if err != nil {
 			logging.FromContext(ctx).Fatalf("failed creating temporary directory in %s: %v", os.TempDir(), err)
@@ -232,35 +1027,182 @@ func main() {
 		*targetDir = newTmpDir
 	}
 
-	if init {
-		repoExists := false
-		// See if the TUF repository already exists; right now we only see if root.json exists,
-		// but this could certainly be made much more sophisticated
-		if _, err := os.Stat(filepath.Join(*targetDir, "repository", "root.json")); err == nil {
-			repoExists = true
+	defs := []repoDefinition{flagRepoDefinition()}
+	if *repoDefsFile != "" {
+		if rotate || update || exportUnsigned || importSignatures {
+			logging.FromContext(ctx).Fatalf("'repositories' can't be used with the '%s' mode", *mode)
+		}
+		var err error
+		defs, err = loadRepoDefinitions(ctx, *repoDefsFile, *targetDir)
+		if err != nil {
+			logging.FromContext(ctx).Fatalf("%v", err)
 		}
+	}
 
-		if repoExists && !overwrite {
-			logging.FromContext(ctx).Infof("TUF repository already exists, skipping initialization...")
-		} else {
-			err := initTUFRepo(ctx, *dir, *targetDir, *secretName, *keysSecretName)
+	// Working directories with the keys needed to keep the repositories
+	// fresh.
+	workDirs := make([]string, len(defs))
+
+	if init {
+		for i, d := range defs {
+			workDir, err := initRepo(ctx, d, overwrite)
 			if err != nil {
 				logging.FromContext(ctx).Fatalf("%v", err)
 			}
-			logging.FromContext(ctx).Infof("tuf repository was created in: %s", *targetDir)
+			workDirs[i] = workDir
+		}
+	}
+
+	if rotate {
+		if err := rotateTUFRoot(ctx, *targetDir, *secretName, *keysSecretName); err != nil {
+			logging.FromContext(ctx).Fatalf("%v", err)
+		}
+		logging.FromContext(ctx).Infof("tuf root was rotated in: %s", *targetDir)
+	}
+
+	if update {
+		if err := updateTUFRepo(ctx, *dir, *targetDir, *secretName, *keysSecretName); err != nil {
+			logging.FromContext(ctx).Fatalf("%v", err)
 		}
+		logging.FromContext(ctx).Infof("tuf repository was updated in: %s", *targetDir)
+	}
+
+	if exportUnsigned || importSignatures {
+		if *ceremonyDir == "" {
+			logging.FromContext(ctx).Fatalf("'ceremony-dir' must be specified to use the '%s' mode", *mode)
+		}
+	}
+
+	if exportUnsigned {
+		if err := exportUnsignedTUFRepo(ctx, *dir, *ceremonyDir); err != nil {
+			logging.FromContext(ctx).Fatalf("%v", err)
+		}
+		logging.FromContext(ctx).Infof("unsigned tuf repository was exported to: %s", *ceremonyDir)
+	}
+
+	if importSignatures {
+		if err := importTUFSignatures(ctx, *ceremonyDir, *targetDir, *secretName, *keysSecretName); err != nil {
+			logging.FromContext(ctx).Fatalf("%v", err)
+		}
+		logging.FromContext(ctx).Infof("tuf repository was signed and published in: %s", *targetDir)
 	}
 
 	if serve {
-		// Serve the TUF repository.
-		serveDir := filepath.Join(*targetDir, "repository")
-		logging.FromContext(ctx).Infof("serving tuf root at %s", serveDir)
-		fs := http.FileServer(http.Dir(serveDir))
-		http.Handle("/", fs)
+		repositories := make([]repository, 0, len(defs))
+		for i, d := range defs {
+			repositories = append(repositories, dirRepository(ctx, d, workDirs[i]))
+		}
+		listenAndServe(ctx, newRepoServer(repositories...))
+	}
+
+	if serveSecret {
+		// Serve the TUF repositories of the repository secrets from memory,
+		// so that any number of replicas can serve them without a shared
+		// volume. The metadata is kept fresh by whoever writes the secrets,
+		// e.g. a server in init-and-serve mode.
+		ns, clientset, err := getNamespaceAndClientset(*noK8s)
+		if err != nil {
+			logging.FromContext(ctx).Fatalf("failed to get namespace and clientset: %v", err)
+		}
+		repositories := make([]repository, 0, len(defs))
+		for _, d := range defs {
+			handler := &secretRepoHandler{}
+			if err := watchRepoSecret(ctx, clientset, ns, d.repoSecretName, handler); err != nil {
+				logging.FromContext(ctx).Fatalf("failed to watch secret %s/%s: %v", ns, d.repoSecretName, err)
+			}
+			logging.FromContext(ctx).Infof("serving tuf root from secret %s/%s", ns, d.repoSecretName)
+			repositories = append(repositories, repository{name: d.name, files: handler, readFile: handler.readFile})
+		}
+		listenAndServe(ctx, newRepoServer(repositories...))
+	}
+}
+
+// initRepo initializes the repository of d, unless it already exists and
+// overwrite is false. It returns the working directory with the keys of the
+// repository, which is empty if they were not loaded.
+func initRepo(ctx context.Context, d repoDefinition, overwrite bool) (string, error) {
+	// See if the TUF repository already exists; right now we only see if root.json exists,
+	// but this could certainly be made much more sophisticated
+	if _, err := os.Stat(filepath.Join(d.targetDir, "repository", "root.json")); err == nil && !overwrite {
+		logging.FromContext(ctx).Infof("TUF repository already exists in %s, skipping initialization...", d.targetDir)
+		return "", nil
+	}
+	workDir, err := initOrAdoptTUFRepo(ctx, d.certsDir, d.targetDir, d.repoSecretName, d.keysSecretName, d.options)
+	if err != nil {
+		return "", err
+	}
+	logging.FromContext(ctx).Infof("tuf repository was created in: %s", d.targetDir)
+	return workDir, nil
+}
 
-		/* #nosec G114 */
-		if err := http.ListenAndServe(":8080", nil); err != nil { //nolint: gosec
-			panic(err)
+// dirRepository returns the repository of d published in its target
+// directory. Its snapshot and timestamp metadata are re-signed every
+// --refresh-interval with the keys in workDir, or loaded from the secrets of
+// d if workDir is empty, by one replica at a time.
+func dirRepository(ctx context.Context, d repoDefinition, workDir string) repository {
+	// Serve the TUF repository. The directory is a symlink to the current
+	// version, which is resolved for every request.
+	serveDir := filepath.Join(d.targetDir, "repository")
+	logging.FromContext(ctx).Infof("serving tuf root at %s", serveDir)
+	if *refreshInterval > 0 {
+		if err := refreshDirRepository(ctx, d, workDir); err != nil {
+			logging.FromContext(ctx).Warnf("not refreshing tuf metadata of %s while serving: %v", serveDir, err)
 		}
 	}
+
+	repoFS := os.DirFS(serveDir)
+	return repository{
+		name:  d.name,
+		files: http.FileServerFS(repoFS),
+		readFile: func(name string) ([]byte, error) {
+			return fs.ReadFile(repoFS, name)
+		},
+	}
+}
+
+// refreshDirRepository starts re-signing the repository of d in the
+// background, with the keys in workDir or the ones in the secrets of d.
+func refreshDirRepository(ctx context.Context, d repoDefinition, workDir string) error {
+	if expires := d.roles["timestamp"].Expires; expires > 0 && expires <= *refreshInterval {
+		logging.FromContext(ctx).Warnf("timestamp expires after %s, which is not longer than the refresh interval %s", expires, *refreshInterval)
+	}
+	if workDir != "" {
+		if err := removeOfflineKeys(workDir); err != nil {
+			return err
+		}
+	}
+	if *noK8s {
+		if workDir == "" {
+			return errors.New("the keys from init are required with --no-k8s")
+		}
+		logging.FromContext(ctx).Infof("re-signing snapshot and timestamp of %s every %s", d.targetDir, *refreshInterval)
+		go refreshTUFRepo(ctx, workDir, d.targetDir, d.repoSecretName, d.roles, *refreshInterval, nil)
+		return nil
+	}
+	if workDir == "" && d.keysSecretName == "" {
+		return errors.New("the keys from init or --keyssecret are required")
+	}
+	ns, clientset, err := getNamespaceAndClientset(*noK8s)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace and clientset: %w", err)
+	}
+	holder, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	go refreshTUFRepoWithLease(ctx, clientset, ns, holder, d, workDir)
+	return nil
+}
+
+// listenAndServe serves the TUF repository with server on --listen-address
+// until ctx is done.
+func listenAndServe(ctx context.Context, server *repoServer) {
+	l, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		logging.FromContext(ctx).Fatalf("failed to listen on %s: %v", *listenAddress, err)
+	}
+	logging.FromContext(ctx).Infof("listening on %s", l.Addr())
+	if err := serveRepo(ctx, l, server, *tlsCert, *tlsKey); err != nil {
+		logging.FromContext(ctx).Fatalf("failed to serve: %v", err)
+	}
 }
@@ -0,0 +1,125 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/fs"
+	"maps"
+	"os"
+	"testing"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestInitTUFRepoReusesKeys(t *testing.T) {
+	defer func(reuse bool) { *reuseKeys = reuse }(*reuseKeys)
+	*reuseKeys = true
+	clientset := fake.NewClientset()
+	defer func(f func() (kubernetes.Interface, error)) { newClientset = f }(newClientset)
+	newClientset = func() (kubernetes.Interface, error) { return clientset, nil }
+	t.Setenv("NAMESPACE", "tuf-system")
+	ctx := context.Background()
+
+	files := map[string][]byte{}
+	for _, name := range []string{"ctfe.pub", "rekor.pub"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		if files[name], err = cryptoutils.MarshalPublicKeyToPEM(key.Public()); err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+	}
+	options := func(manifest *repo.Manifest) repo.CreateRepoOptions {
+		return repo.CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true, Manifest: manifest}
+	}
+	// init returns the data of the repository and keys secrets after an
+	// init with files.
+	init := func() (map[string][]byte, map[string][]byte) {
+		t.Helper()
+		dir, err := initTUFRepo(ctx, files, nil, t.TempDir(), "tuf-root", "tuf-keys", options)
+		if err != nil {
+			t.Fatalf("Failed to initTUFRepo: %v", err)
+		}
+		os.RemoveAll(dir)
+		secrets := clientset.CoreV1().Secrets("tuf-system")
+		repoSecret, err := secrets.Get(ctx, "tuf-root", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get repository secret: %v", err)
+		}
+		keysSecret, err := secrets.Get(ctx, "tuf-keys", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get keys secret: %v", err)
+		}
+		return repoSecret.Data, keysSecret.Data
+	}
+	// repositoryFiles returns the contents of the files of the compressed
+	// repository by path.
+	repositoryFiles := func(compressed []byte) map[string][]byte {
+		t.Helper()
+		fsys, err := repo.UncompressFS(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("Failed to UncompressFS: %v", err)
+		}
+		contents := map[string][]byte{}
+		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			contents[path], err = fs.ReadFile(fsys, path)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to read repository: %v", err)
+		}
+		return contents
+	}
+
+	firstRepo, firstKeys := init()
+	// Keys that are no longer used are deleted from the keys secret.
+	keysSecret, err := clientset.CoreV1().Secrets("tuf-system").Get(ctx, "tuf-keys", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get keys secret: %v", err)
+	}
+	keysSecret.Data["removed.json"] = []byte("{}")
+	if _, err := clientset.CoreV1().Secrets("tuf-system").Update(ctx, keysSecret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update keys secret: %v", err)
+	}
+	secondRepo, secondKeys := init()
+	if !bytes.Equal(firstRepo["root"], secondRepo["root"]) {
+		t.Error("expected the second init to keep the root")
+	}
+	if !maps.EqualFunc(firstKeys, secondKeys, bytes.Equal) {
+		t.Error("expected the second init to keep the keys")
+	}
+	first, second := repositoryFiles(firstRepo["repository"]), repositoryFiles(secondRepo["repository"])
+	for path, content := range first {
+		if !bytes.Equal(content, second[path]) {
+			t.Errorf("expected the second init to keep %s", path)
+		}
+	}
+	if len(first) != len(second) {
+		t.Errorf("expected the second init to keep the %d files of the repository, got %d", len(first), len(second))
+	}
+}
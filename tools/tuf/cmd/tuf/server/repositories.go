@@ -0,0 +1,232 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/logging"
+	"sigs.k8s.io/yaml"
+)
+
+// repositoryNameRegexp matches the names of the repositories, which are used
+// as path prefixes and directory names.
+var repositoryNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// reservedRepositoryNames are the paths the server serves next to the
+// repositories, which can't be used as their names.
+var reservedRepositoryNames = []string{"healthz", "readyz", "metrics", "index.json"}
+
+// repoDefinition is a TUF repository managed by the server: the files it is
+// created from, where it is published and stored, and how it is created.
+type repoDefinition struct {
+	// name is the path prefix the repository is served under, empty for the
+	// single repository configured with flags.
+	name           string
+	certsDir       string
+	targetDir      string
+	repoSecretName string
+	keysSecretName string
+	options        func(*repo.Manifest) repo.CreateRepoOptions
+	roles          map[string]repo.RoleOptions
+}
+
+// flagRepoDefinition returns the definition of the single repository
+// configured with flags.
+func flagRepoDefinition() repoDefinition {
+	return repoDefinition{
+		certsDir:       *dir,
+		targetDir:      *targetDir,
+		repoSecretName: *secretName,
+		keysSecretName: *keysSecretName,
+		options:        createRepoOptions,
+		roles:          roleOptions(),
+	}
+}
+
+// repositoryConfig is a repository in the file given with --repositories.
+// Unset options default to the ones configured with flags.
+type repositoryConfig struct {
+	Name            string                   `json:"name"`
+	FileDir         string                   `json:"fileDir"`
+	RootSecret      string                   `json:"rootSecret,omitempty"`
+	KeysSecret      string                   `json:"keysSecret,omitempty"`
+	MetadataTargets *bool                    `json:"metadataTargets,omitempty"`
+	TrustedRoot     *bool                    `json:"trustedRoot,omitempty"`
+	SigningConfig   *bool                    `json:"signingConfig,omitempty"`
+	Roles           map[string]roleConfig    `json:"roles,omitempty"`
+	Services        map[string]serviceConfig `json:"services,omitempty"`
+	Delegations     []delegationConfig       `json:"delegations,omitempty"`
+}
+
+// roleConfig overrides the options of a top-level role of a repository.
+type roleConfig struct {
+	Keys      int             `json:"keys,omitempty"`
+	Threshold int             `json:"threshold,omitempty"`
+	Expires   metav1.Duration `json:"expires,omitempty"`
+}
+
+// serviceConfig overrides the options of a service of a repository, like
+// the --<service>-* flags.
+type serviceConfig struct {
+	URL        string `json:"url,omitempty"`
+	Origin     string `json:"origin,omitempty"`
+	APIVersion uint32 `json:"apiVersion,omitempty"`
+	Operator   string `json:"operator,omitempty"`
+	Selector   string `json:"selector,omitempty"`
+	Count      uint32 `json:"count,omitempty"`
+}
+
+// loadRepoDefinitions loads the repositories configured in path. Each of
+// them is published in a directory named after it in targetDir.
+func loadRepoDefinitions(ctx context.Context, path, targetDir string) ([]repoDefinition, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repositories: %w", err)
+	}
+	configs := []repositoryConfig{}
+	if err := yaml.UnmarshalStrict(b, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse repositories %s: %w", path, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no repositories in %s", path)
+	}
+	defs := make([]repoDefinition, 0, len(configs))
+	secrets := map[string]string{}
+	for _, c := range configs {
+		d, err := c.definition(ctx, targetDir)
+		if err != nil {
+			return nil, fmt.Errorf("repository %q: %w", c.Name, err)
+		}
+		if slices.ContainsFunc(defs, func(other repoDefinition) bool { return other.name == d.name }) {
+			return nil, fmt.Errorf("repository %s is defined more than once", d.name)
+		}
+		// The secrets also name the init lease of the repository.
+		for _, s := range []string{d.repoSecretName, d.keysSecretName} {
+			if other, ok := secrets[s]; ok {
+				return nil, fmt.Errorf("repositories %s and %s both use secret %s", other, d.name, s)
+			}
+			if s != "" {
+				secrets[s] = d.name
+			}
+		}
+		defs = append(defs, d)
+	}
+	return defs, nil
+}
+
+// definition returns the definition of the repository configured with c.
+func (c repositoryConfig) definition(ctx context.Context, targetDir string) (repoDefinition, error) {
+	if slices.Contains(reservedRepositoryNames, c.Name) {
+		return repoDefinition{}, fmt.Errorf("name must not be one of %v", reservedRepositoryNames)
+	}
+	if !repositoryNameRegexp.MatchString(c.Name) {
+		return repoDefinition{}, errors.New("name must only contain letters, digits, '-' and '_'")
+	}
+	if c.FileDir == "" {
+		return repoDefinition{}, errors.New("fileDir must be specified")
+	}
+	d := repoDefinition{
+		name:           c.Name,
+		certsDir:       c.FileDir,
+		targetDir:      filepath.Join(targetDir, c.Name),
+		repoSecretName: c.RootSecret,
+		keysSecretName: c.KeysSecret,
+		roles:          roleOptions(),
+	}
+	if d.repoSecretName == "" {
+		d.repoSecretName = *secretName + "-" + c.Name
+	}
+	if d.keysSecretName == "" && *keysSecretName != "" {
+		d.keysSecretName = *keysSecretName + "-" + c.Name
+	}
+
+	for role, rc := range c.Roles {
+		opts, ok := d.roles[role]
+		if !ok {
+			return repoDefinition{}, fmt.Errorf("unknown role %s, must be one of %v", role, repo.TopLevelRoles)
+		}
+		if rc.Keys != 0 {
+			opts.Keys = rc.Keys
+		}
+		if rc.Threshold != 0 {
+			opts.Threshold = rc.Threshold
+		}
+		if rc.Expires.Duration != 0 {
+			opts.Expires = rc.Expires.Duration
+		}
+		d.roles[role] = opts
+	}
+
+	services := serviceOptions()
+	for name, sc := range c.Services {
+		service, ok := services[name]
+		if !ok {
+			return repoDefinition{}, fmt.Errorf("unknown service %s, must be one of %v", name, repo.ServiceNames)
+		}
+		if sc.URL != "" {
+			service.URL = sc.URL
+		}
+		if sc.Origin != "" {
+			service.Origin = sc.Origin
+		}
+		if sc.APIVersion != 0 {
+			service.APIVersion = sc.APIVersion
+		}
+		if sc.Operator != "" {
+			service.Operator = sc.Operator
+		}
+		if sc.Selector != "" {
+			service.Selector = sc.Selector
+		}
+		if sc.Count != 0 {
+			service.Count = sc.Count
+		}
+		services[name] = service
+	}
+
+	repoDelegations := delegations
+	if c.Delegations != nil {
+		repoDelegations = toDelegations(ctx, c.Delegations)
+	}
+	roles := d.roles
+	d.options = func(manifest *repo.Manifest) repo.CreateRepoOptions {
+		opts := createRepoOptions(manifest)
+		if c.MetadataTargets != nil {
+			opts.AddMetadataTargets = *c.MetadataTargets
+		}
+		if c.TrustedRoot != nil {
+			opts.AddTrustedRoot = *c.TrustedRoot
+		}
+		if c.SigningConfig != nil {
+			opts.AddSigningConfig = *c.SigningConfig
+		}
+		opts.Roles = maps.Clone(roles)
+		opts.Services = maps.Clone(services)
+		opts.Delegations = repoDelegations
+		return opts
+	}
+	logging.FromContext(ctx).Infof("Repository %s is created from %s and stored in secret %s", d.name, d.certsDir, d.repoSecretName)
+	return d, nil
+}
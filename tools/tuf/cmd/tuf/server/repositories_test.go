@@ -0,0 +1,109 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRepoDefinitions(t *testing.T) {
+	ctx := context.Background()
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "repositories.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write repositories: %v", err)
+		}
+		return path
+	}
+
+	defs, err := loadRepoDefinitions(ctx, write(`
+- name: prod
+  fileDir: /prod
+  keysSecret: prod-keys
+  trustedRoot: false
+  roles:
+    timestamp:
+      expires: 12h
+  services:
+    rekor:
+      url: https://rekor.prod.example.com
+      apiVersion: 1
+  delegations:
+  - name: rekor
+    paths: ["rekor*"]
+- name: staging
+  fileDir: /staging
+  rootSecret: staging-root
+`), "/target")
+	if err != nil {
+		t.Fatalf("Failed to loadRepoDefinitions: %v", err)
+	}
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 repositories, got %d", len(defs))
+	}
+	prod, staging := defs[0], defs[1]
+	if prod.name != "prod" || prod.certsDir != "/prod" || prod.targetDir != filepath.Join("/target", "prod") || prod.repoSecretName != "tuf-root-prod" || prod.keysSecretName != "prod-keys" {
+		t.Errorf("unexpected prod repository %+v", prod)
+	}
+	if staging.repoSecretName != "staging-root" || staging.keysSecretName != "" {
+		t.Errorf("unexpected staging repository %+v", staging)
+	}
+	if got := prod.roles["timestamp"].Expires; got != 12*time.Hour {
+		t.Errorf("expected timestamp of prod to expire after 12h, got %s", got)
+	}
+	if got := staging.roles["timestamp"].Expires; got != 0 {
+		t.Errorf("expected timestamp of staging to default to the flags, got %s", got)
+	}
+	prodOpts, stagingOpts := prod.options(nil), staging.options(nil)
+	if prodOpts.AddTrustedRoot || !prodOpts.AddMetadataTargets || len(prodOpts.Delegations) != 1 || prodOpts.Roles["timestamp"].Expires != 12*time.Hour {
+		t.Errorf("unexpected prod options %+v", prodOpts)
+	}
+	if !stagingOpts.AddTrustedRoot || len(stagingOpts.Delegations) != 0 {
+		t.Errorf("unexpected staging options %+v", stagingOpts)
+	}
+	if got := prodOpts.Services["rekor"]; got.URL != "https://rekor.prod.example.com" || got.APIVersion != 1 {
+		t.Errorf("unexpected rekor service of prod %+v", got)
+	}
+	if got, want := stagingOpts.Services["rekor"], serviceOptions()["rekor"]; got != want {
+		t.Errorf("expected rekor service of staging to default to the flags %+v, got %+v", want, got)
+	}
+
+	for _, tc := range []struct {
+		content string
+		err     string
+	}{
+		{"[]", "no repositories"},
+		{"- name: a/b\n  fileDir: /a", "name must only contain"},
+		{"- name: healthz\n  fileDir: /a", "name must not be one of"},
+		{"- name: readyz\n  fileDir: /a", "name must not be one of"},
+		{"- name: metrics\n  fileDir: /a", "name must not be one of"},
+		{"- name: index.json\n  fileDir: /a", "name must not be one of"},
+		{"- name: a", "fileDir must be specified"},
+		{"- name: a\n  fileDir: /a\n- name: a\n  fileDir: /b\n  rootSecret: b", "defined more than once"},
+		{"- name: a\n  fileDir: /a\n- name: b\n  fileDir: /b\n  rootSecret: tuf-root-a", "both use secret tuf-root-a"},
+		{"- name: a\n  fileDir: /a\n  roles:\n    mirror: {keys: 2}", "unknown role mirror"},
+		{"- name: a\n  fileDir: /a\n  services:\n    mirror: {url: https://mirror}", "unknown service mirror"},
+		{"- name: a\n  fileDir: /a\n  unknown: true", "unknown field"},
+	} {
+		if _, err := loadRepoDefinitions(ctx, write(tc.content), "/target"); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.content, tc.err, err)
+		}
+	}
+}
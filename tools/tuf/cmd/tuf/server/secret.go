@@ -0,0 +1,193 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/logging"
+)
+
+// secretRepoHandler serves the TUF repository stored in the repository
+// secret from memory. The repository is swapped as a whole whenever the
+// secret changes, so that every request sees a consistent repository.
+type secretRepoHandler struct {
+	// current is the repository that was loaded last, if any.
+	current atomic.Pointer[servedRepo]
+	// archive is the compressed repository that was loaded last. It is only
+	// used by load, which is not called concurrently.
+	archive []byte
+}
+
+// servedRepo is a repository served by secretRepoHandler.
+type servedRepo struct {
+	// fsys holds the files of the "repository" directory.
+	fsys    fs.FS
+	handler http.Handler
+	// initialRoot is the 1.root.json of the repository, which all of its
+	// roots descend from.
+	initialRoot []byte
+	// rootVersion and timestampVersion are the versions of the root.json
+	// and timestamp.json that are served, which never go back as long as
+	// the initial root stays the same.
+	rootVersion      int64
+	timestampVersion int64
+}
+
+func (h *secretRepoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	current := h.current.Load()
+	if current == nil {
+		http.Error(w, "the TUF repository has not been loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	current.handler.ServeHTTP(w, r)
+}
+
+// readFile reads the file name of the repository that is currently served.
+func (h *secretRepoHandler) readFile(name string) ([]byte, error) {
+	current := h.current.Load()
+	if current == nil {
+		return nil, errors.New("the TUF repository has not been loaded yet")
+	}
+	return fs.ReadFile(current.fsys, name)
+}
+
+// load verifies the compressed TUF repository and serves it instead of the
+// current one. Repositories that fail verification, or whose root or
+// timestamp version is lower than the one currently served, are not served,
+// so that an old secret can't roll clients back. A repository with another
+// 1.root.json is a new one rather than an old version of the current one,
+// so it is served regardless of its versions.
+func (h *secretRepoHandler) load(ctx context.Context, archive []byte) error {
+	current := h.current.Load()
+	if current != nil && bytes.Equal(archive, h.archive) {
+		return nil
+	}
+	fsys, err := repo.UncompressFS(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("failed to uncompress repository: %w", err)
+	}
+	if err := repo.VerifyRepo(ctx, fsys); err != nil {
+		return fmt.Errorf("failed to verify repository: %w", err)
+	}
+	serveFS, err := fs.Sub(fsys, "repository")
+	if err != nil {
+		return fmt.Errorf("failed to get repository directory: %w", err)
+	}
+	next := &servedRepo{fsys: serveFS, handler: http.FileServerFS(serveFS)}
+	if next.rootVersion, next.timestampVersion, err = repoVersions(serveFS); err != nil {
+		return err
+	}
+	if next.initialRoot, err = fs.ReadFile(serveFS, "1.root.json"); err != nil {
+		return fmt.Errorf("failed to read 1.root.json: %w", err)
+	}
+	if current != nil && !bytes.Equal(next.initialRoot, current.initialRoot) {
+		logging.FromContext(ctx).Warnf("serving a new repository with another 1.root.json, clients of the previous repository have to be given its root.json to update")
+	} else if current != nil && (next.rootVersion < current.rootVersion || next.timestampVersion < current.timestampVersion) {
+		return fmt.Errorf("refusing to roll back from root version %d and timestamp version %d to root version %d and timestamp version %d",
+			current.rootVersion, current.timestampVersion, next.rootVersion, next.timestampVersion)
+	}
+	h.current.Store(next)
+	h.archive = archive
+	return nil
+}
+
+// repoVersions returns the versions of the root.json and timestamp.json in
+// fsys.
+func repoVersions(fsys fs.FS) (int64, int64, error) {
+	b, err := fs.ReadFile(fsys, "root.json")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read root.json: %w", err)
+	}
+	root, err := metadata.Root().FromBytes(b)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse root.json: %w", err)
+	}
+	if b, err = fs.ReadFile(fsys, "timestamp.json"); err != nil {
+		return 0, 0, fmt.Errorf("failed to read timestamp.json: %w", err)
+	}
+	timestamp, err := metadata.Timestamp().FromBytes(b)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse timestamp.json: %w", err)
+	}
+	return root.Signed.Version, timestamp.Signed.Version, nil
+}
+
+// loadSecret loads the repository of the secret obj into h, logging any
+// problem as the informer event handlers can't return errors.
+func (h *secretRepoHandler) loadSecret(ctx context.Context, obj any) {
+	s, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	archive, ok := s.Data["repository"]
+	if !ok {
+		logging.FromContext(ctx).Errorf("secret %s/%s does not contain a repository, keeping the current one", s.Namespace, s.Name)
+		return
+	}
+	if err := h.load(ctx, archive); err != nil {
+		logging.FromContext(ctx).Errorf("not serving the repository of secret %s/%s: %v", s.Namespace, s.Name, err)
+		return
+	}
+	logging.FromContext(ctx).Infof("serving the repository of secret %s/%s at resource version %s", s.Namespace, s.Name, s.ResourceVersion)
+}
+
+// watchRepoSecret loads the TUF repository of the secret name in ns into h
+// and reloads it whenever the secret changes, until ctx is done. It returns
+// once the secret was listed and, if it already exists, loaded.
+func watchRepoSecret(ctx context.Context, clientset kubernetes.Interface, ns, name string, h *secretRepoHandler) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	// The handlers are called one at a time, in the order of the events.
+	registration, err := informer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj any) bool {
+			s, ok := obj.(*corev1.Secret)
+			return ok && s.Name == name
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj any) { h.loadSecret(ctx, obj) },
+			UpdateFunc: func(_, obj any) { h.loadSecret(ctx, obj) },
+			DeleteFunc: func(any) {
+				logging.FromContext(ctx).Warnf("secret %s/%s was deleted, keeping the current repository", ns, name)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add secret event handler: %w", err)
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		return errors.New("failed to list secrets before the context was done")
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigstore/scaffolding/tools/tuf/pkg/repo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// compressedRepo creates a TUF repository with the given target and returns
+// it compressed, along with its root.json.
+func compressedRepo(t *testing.T, name, content string) ([]byte, []byte) {
+	t.Helper()
+	m, err := repo.CreateRepoInMemory(context.Background(), map[string][]byte{name: []byte(content)}, repo.CreateRepoOptions{AddMetadataTargets: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoInMemory: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := repo.CompressFS(m.FS(), &buf, map[string]bool{"keys": true}); err != nil {
+		t.Fatalf("Failed to CompressFS: %v", err)
+	}
+	meta, err := m.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+	return buf.Bytes(), meta["root.json"]
+}
+
+// get returns the status code and the body of the response to a GET of path.
+func get(t *testing.T, server *httptest.Server, path string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("Failed to GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return resp.StatusCode, body
+}
+
+// eventually polls check until it returns true or a few seconds passed.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if check() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestWatchRepoSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewClientset()
+	secrets := clientset.CoreV1().Secrets("tuf-system")
+	handler := &secretRepoHandler{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Nothing is served until the secret exists.
+	if err := watchRepoSecret(ctx, clientset, "tuf-system", "tuf-root", handler); err != nil {
+		t.Fatalf("Failed to watchRepoSecret: %v", err)
+	}
+	if code, _ := get(t, server, "/root.json"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d before the secret exists, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	first, firstRoot := compressedRepo(t, "rekor.pub", "first")
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tuf-system", Name: "tuf-root"},
+		Data:       map[string][]byte{"repository": first},
+	}
+	if _, err := secrets.Create(ctx, s, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+	eventually(t, "the first repository", func() bool {
+		code, body := get(t, server, "/root.json")
+		return code == http.StatusOK && bytes.Equal(body, firstRoot)
+	})
+
+	// Other secrets are ignored.
+	other, _ := compressedRepo(t, "rekor.pub", "other")
+	if _, err := secrets.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tuf-system", Name: "tuf-keys"},
+		Data:       map[string][]byte{"repository": other},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+
+	// Repositories that can't be verified are not served.
+	s.Data["repository"] = []byte("invalid")
+	if _, err := secrets.Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update secret: %v", err)
+	}
+
+	second, secondRoot := compressedRepo(t, "rekor.pub", "second")
+	s.Data["repository"] = second
+	if _, err := secrets.Update(ctx, s, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update secret: %v", err)
+	}
+	// The events are handled in order, so the first repository is served
+	// until the second one is.
+	eventually(t, "the second repository", func() bool {
+		code, body := get(t, server, "/root.json")
+		if code != http.StatusOK || !bytes.Equal(body, firstRoot) && !bytes.Equal(body, secondRoot) {
+			t.Fatalf("unexpected response %d: %s", code, body)
+		}
+		return bytes.Equal(body, secondRoot)
+	})
+}
+
+func TestSecretRepoHandlerRejectsRollback(t *testing.T) {
+	ctx := context.Background()
+	_, dir, err := repo.CreateRepoWithOptions(ctx, map[string][]byte{"rekor.pub": []byte("rekor")}, repo.CreateRepoOptions{AddMetadataTargets: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	compress := func() []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := repo.CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+			t.Fatalf("Failed to CompressFS: %v", err)
+		}
+		return buf.Bytes()
+	}
+	initial := compress()
+	if _, err := repo.ResignOnlineRoles(ctx, dir, nil); err != nil {
+		t.Fatalf("Failed to ResignOnlineRoles: %v", err)
+	}
+	resigned := compress()
+	if _, err := repo.RotateRoot(ctx, dir, nil); err != nil {
+		t.Fatalf("Failed to RotateRoot: %v", err)
+	}
+	rotated := compress()
+
+	h := &secretRepoHandler{}
+	for _, step := range []struct {
+		name     string
+		archive  []byte
+		rollback bool
+	}{
+		{"initial", initial, false},
+		{"resigned", resigned, false},
+		{"older timestamp", initial, true},
+		{"rotated", rotated, false},
+		{"older root", resigned, true},
+	} {
+		err := h.load(ctx, step.archive)
+		switch {
+		case step.rollback && (err == nil || !strings.Contains(err.Error(), "roll back")):
+			t.Errorf("%s: expected a rollback error, got %v", step.name, err)
+		case !step.rollback && err != nil:
+			t.Errorf("%s: Failed to load: %v", step.name, err)
+		}
+	}
+	served, err := h.readFile("root.json")
+	if err != nil {
+		t.Fatalf("Failed to read root.json: %v", err)
+	}
+	if want, err := os.ReadFile(filepath.Join(dir, "repository", "root.json")); err != nil || !bytes.Equal(served, want) {
+		t.Errorf("expected the rotated root to be served: %v", err)
+	}
+
+	// A repository with another initial root replaces the current one,
+	// whatever its versions.
+	other, otherRoot := compressedRepo(t, "rekor.pub", "other rekor")
+	if err := h.load(ctx, other); err != nil {
+		t.Fatalf("Failed to load another repository: %v", err)
+	}
+	if served, err = h.readFile("root.json"); err != nil || !bytes.Equal(served, otherRoot) {
+		t.Errorf("expected the root of the other repository to be served: %v", err)
+	}
+}
@@ -30,8 +30,9 @@ import (
 // <optional>...
 // <optional> tsa_intermediate_n.crt.pem
 // tsa_leaf.crt.pem
-// The assumption is that the first entry is the `Leaf` followed by 0 or more
-// intermediates and the last entry is the `root`.
+// The first entry has to be the `Leaf` followed by 0 or more intermediates
+// and the last entry has to be the `root`, each certificate issued by the
+// next one. Chains that are out of order are rejected.
 func SplitCertChain(chain []byte, prefix string) (map[string][]byte, error) {
 	ret := make(map[string][]byte, 3) // we asssume there's 3, no harm if less.
 
@@ -43,6 +44,11 @@ func SplitCertChain(chain []byte, prefix string) (map[string][]byte, error) {
 		// Need at least a root and leaf
 		return nil, fmt.Errorf("cert chain must contain at least root and leaf, but got only %d certs", len(certs))
 	}
+	for i := 0; i < len(certs)-1; i++ {
+		if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+			return nil, fmt.Errorf("cert chain is out of order or doesn't verify, cert %d %q is not issued by cert %d %q: %w", i, certs[i].Subject, i+1, certs[i+1].Subject, err)
+		}
+	}
 	// handle leaf
 	leaf, err := cryptoutils.MarshalCertificateToPEM(certs[0])
 	if err != nil {
@@ -129,3 +129,14 @@ func TestSplitCertChainErrors(t *testing.T) {
 		t.Errorf("Unexpected error message, want: %s got: %s", wantErr, err.Error())
 	}
 }
+
+func TestSplitCertChainOutOfOrder(t *testing.T) {
+	wantErr := "out of order"
+	_, err := SplitCertChain([]byte(root+intermediate), "tsa")
+	if err == nil {
+		t.Fatalf("did not get error when wanted one")
+	}
+	if !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("Unexpected error message, want: %s got: %s", wantErr, err.Error())
+	}
+}
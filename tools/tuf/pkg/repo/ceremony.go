@@ -0,0 +1,274 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/secure-systems-lab/go-securesystemslib/cjson"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"knative.dev/pkg/logging"
+)
+
+// OfflineRoles are the roles whose keys can be held offline in a signing
+// ceremony, see ExportUnsigned and ImportSignatures.
+var OfflineRoles = []string{"root", "targets"}
+
+// ExportUnsigned is the first phase of a signing ceremony with offline keys.
+// Like CreateRepoWithOptions it creates a new TUF repository for files, but
+// in dir, and the roles in offlineKeys (root and/or targets) only get the
+// given public keys instead of generated ones. Their metadata is staged
+// without signatures, and the canonical payloads that have to be signed
+// offline are returned by metadata file name, e.g. "root.json".
+// The snapshot and timestamp keys are generated as usual and kept in dir for
+// ImportSignatures. Delegations are not supported.
+func ExportUnsigned(ctx context.Context, dir string, files map[string][]byte, offlineKeys map[string][]*metadata.Key, options CreateRepoOptions) (map[string][]byte, error) {
+	if len(options.Delegations) > 0 {
+		return nil, errors.New("delegations are not supported in signing ceremonies")
+	}
+	roles, err := offlineRoles(options.Roles, offlineKeys)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+	targets, err := constructTargets(files, options, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create TUF dir: %w", err)
+	}
+	logging.FromContext(ctx).Infof("Creating the FS in %q", dir)
+	logging.FromContext(ctx).Infof("Creating new repo")
+	r, err := newTUFRepo(newDirFS(dir), roles, offlineKeys, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		logging.FromContext(ctx).Infof("Adding file: %s", t.Name)
+		if err := r.addTarget(t.Name, t.Bytes, t.CustomMetadata); err != nil {
+			return nil, fmt.Errorf("failed to add target %s: %w", t.Name, err)
+		}
+		r.pending = append(r.pending, repoFile{name: path.Join("staged", "targets", t.Name), content: t.Bytes, perm: 0644})
+	}
+	for _, role := range TopLevelRoles {
+		if err := r.saveKeys(role); err != nil {
+			return nil, err
+		}
+	}
+
+	// Root and targets are staged with the signatures of the keys at hand,
+	// the offline ones are added by ImportSignatures.
+	if err := signMetadata(r.root, r.keys["root"]); err != nil {
+		return nil, fmt.Errorf("failed to sign root: %w", err)
+	}
+	if err := signMetadata(r.targets, r.keys["targets"]); err != nil {
+		return nil, fmt.Errorf("failed to sign targets: %w", err)
+	}
+	rootJSON, err := r.root.ToBytes(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal root: %w", err)
+	}
+	targetsJSON, err := r.targets.ToBytes(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal targets: %w", err)
+	}
+	r.pending = append(r.pending,
+		repoFile{name: "staged/root.json", content: rootJSON, perm: 0644},
+		repoFile{name: "staged/targets.json", content: targetsJSON, perm: 0644})
+
+	payloads := map[string][]byte{}
+	for role := range offlineKeys {
+		payload, err := r.payload(role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s payload: %w", role, err)
+		}
+		payloads[role+".json"] = payload
+	}
+	if err := r.write(); err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+// ImportSignatures is the second phase of a signing ceremony with offline
+// keys. It adds the signatures made offline over the payloads returned by
+// ExportUnsigned to the staged metadata of the repository in dir, and then
+// signs new snapshot and timestamp metadata and commits the repository.
+// signatures are keyed by metadata file name, e.g. "root.json". Only the
+// snapshot and timestamp options of roles are used.
+func ImportSignatures(ctx context.Context, dir string, signatures map[string][]metadata.Signature, roles map[string]RoleOptions) (LocalStore, error) {
+	roles = map[string]RoleOptions{"snapshot": roles["snapshot"], "timestamp": roles["timestamp"]}
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+
+	fsys := newDirFS(dir)
+	r, err := openStagedRepo(fsys)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(signatures)) {
+		role := strings.TrimSuffix(name, ".json")
+		if !slices.Contains(OfflineRoles, role) {
+			return nil, fmt.Errorf("signatures for %s can't be imported, only for %s", name, strings.Join(OfflineRoles, " and "))
+		}
+		payload, err := r.payload(role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s payload: %w", role, err)
+		}
+		for _, sig := range signatures[name] {
+			if err := verifySignature(&r.root.Signed, role, payload, sig); err != nil {
+				return nil, fmt.Errorf("failed to add signature by key %s to %s: %w", sig.KeyID, name, err)
+			}
+			if role == "root" {
+				r.root.Signatures = addSignature(r.root.Signatures, sig)
+			} else {
+				r.targets.Signatures = addSignature(r.targets.Signatures, sig)
+			}
+		}
+		logging.FromContext(ctx).Infof("Added %d signatures to %s", len(signatures[name]), name)
+	}
+
+	if err := r.signRoot(); err != nil {
+		return nil, err
+	}
+	if err := r.signTargets(); err != nil {
+		return nil, err
+	}
+	if err := r.signOnlineRoles(roles, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := r.write(); err != nil {
+		return nil, err
+	}
+	if err := fsys.removeAll("staged"); err != nil {
+		return nil, fmt.Errorf("failed to remove staged metadata: %w", err)
+	}
+	return fsStore{fsys}, nil
+}
+
+// openStagedRepo opens the repository in fsys staged by ExportUnsigned.
+func openStagedRepo(fsys repoFS) (*tufRepo, error) {
+	if _, err := fs.Stat(fsys, "staged/root.json"); err != nil {
+		return nil, fmt.Errorf("no metadata is waiting for signatures: %w", err)
+	}
+	r := &tufRepo{
+		fsys:          fsys,
+		delegated:     map[string]*metadata.Metadata[metadata.TargetsType]{},
+		keys:          map[string][]*signingKey{},
+		files:         map[string][]byte{},
+		signedTargets: map[string]*metadata.MetaFiles{},
+	}
+	var err error
+	if r.root, err = readMetadata[metadata.RootType](fsys, "staged/root.json"); err != nil {
+		return nil, err
+	}
+	if r.targets, err = readMetadata[metadata.TargetsType](fsys, "staged/targets.json"); err != nil {
+		return nil, err
+	}
+	for name := range r.targets.Signed.Targets {
+		if r.files[name], err = fs.ReadFile(fsys, path.Join("staged", "targets", name)); err != nil {
+			return nil, fmt.Errorf("failed to read staged target %s: %w", name, err)
+		}
+	}
+	if err := r.loadKeys(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// payload returns the canonical form of the root or targets metadata of r
+// that signatures are made over.
+func (r *tufRepo) payload(role string) ([]byte, error) {
+	if role == "root" {
+		return cjson.EncodeCanonical(r.root.Signed)
+	}
+	return cjson.EncodeCanonical(r.targets.Signed)
+}
+
+// verifySignature checks that sig is a signature over payload by one of the
+// keys of role in root.
+func verifySignature(root *metadata.RootType, role string, payload []byte, sig metadata.Signature) error {
+	if !slices.Contains(root.Roles[role].KeyIDs, sig.KeyID) {
+		return fmt.Errorf("key %s is not a %s key", sig.KeyID, role)
+	}
+	pub, err := root.Keys[sig.KeyID].ToPublicKey()
+	if err != nil {
+		return err
+	}
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	return verifier.VerifySignature(bytes.NewReader(sig.Signature), bytes.NewReader(payload))
+}
+
+// addSignature adds sig to sigs, replacing an earlier signature by the same
+// key.
+func addSignature(sigs []metadata.Signature, sig metadata.Signature) []metadata.Signature {
+	sigs = slices.DeleteFunc(sigs, func(s metadata.Signature) bool { return s.KeyID == sig.KeyID })
+	return append(sigs, sig)
+}
+
+// offlineRoles checks that the offline keys can be used for their roles and
+// returns roles with the number of keys of those roles set accordingly.
+func offlineRoles(roles map[string]RoleOptions, offlineKeys map[string][]*metadata.Key) (map[string]RoleOptions, error) {
+	if len(offlineKeys) == 0 {
+		return nil, errors.New("no offline keys given")
+	}
+	roles = maps.Clone(roles)
+	if roles == nil {
+		roles = map[string]RoleOptions{}
+	}
+	for role, pks := range offlineKeys {
+		if !slices.Contains(OfflineRoles, role) {
+			return nil, fmt.Errorf("role %s can't have offline keys, only %s", role, strings.Join(OfflineRoles, " and "))
+		}
+		if len(pks) == 0 {
+			return nil, fmt.Errorf("role %s: no offline keys given", role)
+		}
+		for _, pk := range pks {
+			if _, err := pk.ToPublicKey(); err != nil {
+				return nil, fmt.Errorf("role %s: invalid offline key: %w", role, err)
+			}
+		}
+		o := roles[role]
+		if o.Signer != nil {
+			return nil, fmt.Errorf("role %s: can't have both offline keys and a signer", role)
+		}
+		if o.Keys != 0 && o.Keys != len(pks) {
+			return nil, fmt.Errorf("role %s: %d keys are configured, but %d offline keys are given", role, o.Keys, len(pks))
+		}
+		o.Keys = len(pks)
+		roles[role] = o
+	}
+	return roles, nil
+}
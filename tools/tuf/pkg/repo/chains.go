@@ -0,0 +1,246 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+// chainMember is a file holding one or more certificates of a chain. The
+// certificates of a file are ordered from the leaf towards the root, each
+// one issued by the next.
+type chainMember struct {
+	target ManifestTarget
+	certs  []*x509.Certificate
+}
+
+// top returns the certificate of the member closest to the root.
+func (m chainMember) top() *x509.Certificate {
+	return m.certs[len(m.certs)-1]
+}
+
+// bottom returns the certificate of the member closest to the leaf.
+func (m chainMember) bottom() *x509.Certificate {
+	return m.certs[0]
+}
+
+// newChainMember parses the certificates of the file described by t and
+// checks that they are in order.
+func newChainMember(t ManifestTarget, pemBytes []byte) (chainMember, error) {
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM(pemBytes)
+	if err != nil {
+		return chainMember{}, fmt.Errorf("failed to parse certificates in %s: %w", t.Name, err)
+	}
+	if len(certs) == 0 {
+		return chainMember{}, fmt.Errorf("no certificates found in %s", t.Name)
+	}
+	for i := 0; i < len(certs)-1; i++ {
+		if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+			return chainMember{}, fmt.Errorf("certificates in %s are out of order or don't verify: %q is not issued by %q: %w", t.Name, certs[i].Subject, certs[i+1].Subject, err)
+		}
+	}
+	return chainMember{target: t, certs: certs}, nil
+}
+
+// certChain holds the certificates of a single Fulcio or TSA certificate
+// chain.
+type certChain struct {
+	members []chainMember
+}
+
+// targets returns the manifest entries of the certificates in the chain.
+func (c *certChain) targets() []ManifestTarget {
+	targets := make([]ManifestTarget, 0, len(c.members))
+	for _, m := range c.members {
+		targets = append(targets, m.target)
+	}
+	return targets
+}
+
+// pem returns the certificates of the chain in PEM format, ordered from the
+// leaf to the root. The chain is built by following the signatures from the
+// root down, so every certificate has to be issued by the one after it.
+func (c *certChain) pem() ([]byte, error) {
+	rootIdx := slices.IndexFunc(c.members, func(m chainMember) bool { return isRoot(m.target) })
+	if rootIdx < 0 {
+		return nil, fmt.Errorf("no root certificate found among %s", c.names())
+	}
+	root := c.members[rootIdx].top()
+	if bytes.Equal(root.RawIssuer, root.RawSubject) {
+		if err := root.CheckSignatureFrom(root); err != nil {
+			return nil, fmt.Errorf("root certificate %q in %s doesn't verify: %w", root.Subject, c.members[rootIdx].target.Name, err)
+		}
+	}
+
+	ordered := []chainMember{c.members[rootIdx]}
+	remaining := slices.Delete(slices.Clone(c.members), rootIdx, rootIdx+1)
+	for len(remaining) > 0 {
+		issuer := ordered[0].bottom()
+		var next []int
+		for i, m := range remaining {
+			if m.top().CheckSignatureFrom(issuer) == nil {
+				next = append(next, i)
+			}
+		}
+		switch len(next) {
+		case 0:
+			orphaned := make([]string, 0, len(remaining))
+			for _, m := range remaining {
+				orphaned = append(orphaned, fmt.Sprintf("%q in %s", m.top().Subject, m.target.Name))
+			}
+			return nil, fmt.Errorf("certificate %s is orphaned, it isn't issued by %q or any certificate below it", strings.Join(orphaned, ", "), issuer.Subject)
+		case 1:
+			ordered = append([]chainMember{remaining[next[0]]}, ordered...)
+			remaining = slices.Delete(remaining, next[0], next[0]+1)
+		default:
+			return nil, fmt.Errorf("both %s and %s are issued by %q", remaining[next[0]].target.Name, remaining[next[1]].target.Name, issuer.Subject)
+		}
+	}
+
+	for i, m := range ordered {
+		if m.target.Certificate == LeafCertificate && i != 0 {
+			return nil, fmt.Errorf("leaf certificate %s is not at the end of the chain, %s is issued by it", m.target.Name, ordered[i-1].target.Name)
+		}
+	}
+
+	var chainPEM []byte
+	for _, m := range ordered {
+		for _, cert := range m.certs {
+			certPEM, err := cryptoutils.MarshalCertificateToPEM(cert)
+			if err != nil {
+				return nil, err
+			}
+			chainPEM = append(chainPEM, certPEM...)
+		}
+	}
+	return chainPEM, nil
+}
+
+func (c *certChain) names() string {
+	names := make([]string, 0, len(c.members))
+	for _, m := range c.members {
+		names = append(names, m.target.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// certChains groups certificates into chains. Certificates in the same group
+// and with the same status and validity window in the manifest belong
+// together, so retired chains are listed next to the active ones. If such a
+// group holds more than one root, the certificates are assigned to the roots
+// they were issued by.
+type certChains struct {
+	keys   []string
+	groups map[string][]chainMember
+}
+
+// add adds the certificates in the file described by t to their group.
+func (c *certChains) add(t ManifestTarget, pemBytes []byte) error {
+	m, err := newChainMember(t, pemBytes)
+	if err != nil {
+		return err
+	}
+	key := chainKey(t)
+	if c.groups == nil {
+		c.groups = map[string][]chainMember{}
+	}
+	if _, ok := c.groups[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.groups[key] = append(c.groups[key], m)
+	return nil
+}
+
+// build returns the chains of all the added certificates.
+func (c *certChains) build() ([]*certChain, error) {
+	chains := []*certChain{}
+	for _, key := range c.keys {
+		members := c.groups[key]
+		roots := slices.DeleteFunc(slices.Clone(members), func(m chainMember) bool { return !isRoot(m.target) })
+		if len(roots) <= 1 {
+			chains = append(chains, &certChain{members: members})
+			continue
+		}
+
+		linked, err := linkChains(members)
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, linked...)
+	}
+	return chains, nil
+}
+
+// linkChains splits members with more than one root into chains, by
+// checking which of the certificates already in a chain issued the
+// remaining ones.
+func linkChains(members []chainMember) ([]*certChain, error) {
+	chains := []*certChain{}
+	pending := []chainMember{}
+	for _, m := range members {
+		if isRoot(m.target) {
+			chains = append(chains, &certChain{members: []chainMember{m}})
+		} else {
+			pending = append(pending, m)
+		}
+	}
+
+	for len(pending) > 0 {
+		progress := false
+		for i := 0; i < len(pending); i++ {
+			m := pending[i]
+			idx := slices.IndexFunc(chains, func(c *certChain) bool {
+				return slices.ContainsFunc(c.members, func(issuer chainMember) bool {
+					return m.top().CheckSignatureFrom(issuer.bottom()) == nil
+				})
+			})
+			if idx < 0 {
+				continue
+			}
+			chains[idx].members = append(chains[idx].members, m)
+			pending = slices.Delete(pending, i, i+1)
+			i--
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("certificate %s was not issued by any of the root certificates", pending[0].target.Name)
+		}
+	}
+	return chains, nil
+}
+
+func isRoot(t ManifestTarget) bool {
+	return t.Certificate == "" || t.Certificate == RootCertificate
+}
+
+// chainKey returns the key of the group the certificate described by t
+// belongs to.
+func chainKey(t ManifestTarget) string {
+	key := t.Group + "/" + t.status()
+	for _, tm := range []*time.Time{t.ValidFrom, t.ValidUntil} {
+		key += "/"
+		if tm != nil {
+			key += tm.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return key
+}
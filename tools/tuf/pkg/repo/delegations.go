@@ -0,0 +1,206 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Delegation configures a delegated targets role. The targets whose names
+// match its Paths are signed by the keys of the delegated role instead of the
+// ones of the top-level targets role, so that they can be changed without
+// the targets keys, e.g. when the key of a single service is rotated.
+// Note that trusted_root.json and signing_config.v0.2.json are targets as
+// well, and are signed by the targets role unless they are delegated too.
+type Delegation struct {
+	// Name is the name of the role, e.g. "rekor". It must not be one of the
+	// TopLevelRoles and may only contain letters, digits, "-" and "_".
+	Name string
+	// Paths are the patterns of the names of the targets of the role, e.g.
+	// "rekor*.pub". A "*" matches any number of characters but "/". Targets
+	// matching the paths of more than one delegation are signed by the first
+	// of them.
+	Paths []string
+	// RoleOptions configures the keys and expiration of the role. Signers
+	// are not supported for delegated roles.
+	RoleOptions
+}
+
+var delegationNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// validateDelegations checks that the given delegations can be satisfied.
+func validateDelegations(delegations []Delegation) error {
+	seen := map[string]bool{}
+	for _, d := range delegations {
+		if !delegationNameRegexp.MatchString(d.Name) {
+			return fmt.Errorf("invalid delegated role name %q", d.Name)
+		}
+		if slices.Contains(TopLevelRoles, d.Name) {
+			return fmt.Errorf("delegated role %s has the name of a top-level role", d.Name)
+		}
+		if seen[d.Name] {
+			return fmt.Errorf("delegated role %s is configured more than once", d.Name)
+		}
+		seen[d.Name] = true
+		if len(d.Paths) == 0 {
+			return fmt.Errorf("delegated role %s: no paths given", d.Name)
+		}
+		for _, p := range d.Paths {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("delegated role %s: invalid path %q: %w", d.Name, p, err)
+			}
+		}
+		if err := validateRole(d.Name, d.RoleOptions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delegationOptions returns the RoleOptions of the delegated role name in
+// delegations, or the defaults if it is not configured.
+func delegationOptions(delegations []Delegation, name string) RoleOptions {
+	for _, d := range delegations {
+		if d.Name == name {
+			return d.RoleOptions
+		}
+	}
+	return RoleOptions{}
+}
+
+// addDelegations delegates the targets matching the paths of delegations to
+// new roles with generated keys, in order. Like the top-level roles, the new
+// roles are only signed later on.
+func (r *tufRepo) addDelegations(delegations []Delegation, now time.Time) error {
+	if len(delegations) == 0 {
+		return nil
+	}
+	r.targets.Signed.Delegations = &metadata.Delegations{Keys: map[string]*metadata.Key{}}
+	for _, d := range delegations {
+		// Clients have to find the targets of a delegated role in its
+		// metadata, even if other roles are delegated the same paths.
+		r.targets.Signed.Delegations.Roles = append(r.targets.Signed.Delegations.Roles, metadata.DelegatedRole{
+			Name:        d.Name,
+			KeyIDs:      []string{},
+			Threshold:   d.threshold(),
+			Terminating: true,
+			Paths:       slices.Clone(d.Paths),
+		})
+		for i := 0; i < d.keys(); i++ {
+			key, sk, err := generateKey()
+			if err != nil {
+				return fmt.Errorf("failed to generate %s key: %w", d.Name, err)
+			}
+			if err := r.targets.Signed.AddKey(key, d.Name); err != nil {
+				return fmt.Errorf("failed to add %s key: %w", d.Name, err)
+			}
+			r.keys[d.Name] = append(r.keys[d.Name], sk)
+		}
+		r.delegated[d.Name] = metadata.Targets(d.expires(now))
+	}
+	return nil
+}
+
+// checkDelegations checks that delegations are the ones of the repository,
+// as delegations can only be configured when a repository is created.
+func (r *tufRepo) checkDelegations(delegations []Delegation) error {
+	for _, d := range delegations {
+		role, ok := r.delegatedRole(d.Name)
+		if !ok {
+			return fmt.Errorf("delegated role %s does not exist in the repository", d.Name)
+		}
+		if !slices.Equal(role.Paths, d.Paths) {
+			return fmt.Errorf("delegated role %s is delegated other paths in the repository", d.Name)
+		}
+	}
+	return nil
+}
+
+// delegatedRoles returns the names of the delegated roles of the repository,
+// in order.
+func (r *tufRepo) delegatedRoles() []string {
+	if r.targets.Signed.Delegations == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.targets.Signed.Delegations.Roles))
+	for _, role := range r.targets.Signed.Delegations.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// delegatedRole returns the delegated role name as described in targets.json.
+func (r *tufRepo) delegatedRole(name string) (*metadata.DelegatedRole, bool) {
+	if r.targets.Signed.Delegations == nil {
+		return nil, false
+	}
+	for i, role := range r.targets.Signed.Delegations.Roles {
+		if role.Name == name {
+			return &r.targets.Signed.Delegations.Roles[i], true
+		}
+	}
+	return nil, false
+}
+
+// readDelegations reads the metadata of the delegated roles of the
+// repository.
+func (r *tufRepo) readDelegations() error {
+	for _, name := range r.delegatedRoles() {
+		if !delegationNameRegexp.MatchString(name) {
+			return fmt.Errorf("unsupported delegated role name %q", name)
+		}
+		md, err := readMetadata[metadata.TargetsType](r.fsys, path.Join("repository", name+".json"))
+		if err != nil {
+			return err
+		}
+		r.delegated[name] = md
+	}
+	return nil
+}
+
+// targetsRole returns the name and the metadata of the role that signs the
+// target name: the first delegated role whose paths match the name, or the
+// top-level targets role.
+func (r *tufRepo) targetsRole(name string) (string, *metadata.Metadata[metadata.TargetsType], error) {
+	if r.targets.Signed.Delegations != nil {
+		for _, role := range r.targets.Signed.Delegations.Roles {
+			ok, err := role.IsDelegatedPath(name)
+			if err != nil {
+				return "", nil, err
+			}
+			if !ok {
+				continue
+			}
+			md, ok := r.delegated[role.Name]
+			if !ok {
+				return "", nil, fmt.Errorf("metadata of delegated role %s is missing", role.Name)
+			}
+			return role.Name, md, nil
+		}
+	}
+	return "targets", r.targets, nil
+}
+
+// signDelegation signs the metadata of the delegated role name and queues it
+// for writing, along with the targets that were added to it.
+func (r *tufRepo) signDelegation(name string) error {
+	return r.signTargetsMetadata(name, r.delegated[name], r.targets)
+}
@@ -0,0 +1,343 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Inspection describes a TUF repository as found by InspectRepo.
+type Inspection struct {
+	// Roles are the roles of the repository, in the order they are
+	// verified: root, timestamp, snapshot, targets and the delegated roles.
+	Roles []RoleInspection `json:"roles"`
+	// Targets are the targets of all the targets roles, by name.
+	Targets []TargetInspection `json:"targets"`
+	// TrustedRoot summarizes trusted_root.json, if it is a target.
+	TrustedRoot *TrustedRootInspection `json:"trustedRoot,omitempty"`
+	// Errors are the problems found while verifying the repository. The
+	// repository is valid if there are none, but note that expired
+	// metadata is only reported in Roles.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// RoleInspection describes the current metadata of a role.
+type RoleInspection struct {
+	Name       string    `json:"name"`
+	Version    int64     `json:"version"`
+	Expires    time.Time `json:"expires"`
+	Expired    bool      `json:"expired"`
+	Threshold  int       `json:"threshold"`
+	KeyIDs     []string  `json:"keyIDs"`
+	Signatures int       `json:"signatures"`
+}
+
+// TargetInspection describes a target and the role that signs it.
+type TargetInspection struct {
+	Name     string            `json:"name"`
+	Role     string            `json:"role"`
+	Length   int64             `json:"length"`
+	Hashes   map[string]string `json:"hashes"`
+	Sigstore *CustomMetadata   `json:"sigstore,omitempty"`
+}
+
+// TrustedRootInspection summarizes the entries of trusted_root.json.
+type TrustedRootInspection struct {
+	CertificateAuthorities []AuthorityInspection `json:"certificateAuthorities"`
+	TimestampAuthorities   []AuthorityInspection `json:"timestampAuthorities"`
+	TransparencyLogs       []LogInspection       `json:"tlogs"`
+	CTLogs                 []LogInspection       `json:"ctlogs"`
+}
+
+// AuthorityInspection describes a certificate or timestamp authority of
+// trusted_root.json by the subject of its root certificate.
+type AuthorityInspection struct {
+	URI        string     `json:"uri"`
+	Subject    string     `json:"subject"`
+	ValidFrom  time.Time  `json:"validFrom"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+}
+
+// LogInspection describes a transparency log of trusted_root.json.
+type LogInspection struct {
+	BaseURL    string     `json:"baseURL"`
+	LogID      string     `json:"logID"`
+	ValidFrom  time.Time  `json:"validFrom"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+}
+
+// InspectRepo verifies the TUF repository in fsys, laid out like the
+// directory returned by CreateRepoWithOptions or by Uncompress, and describes
+// it. The signatures are verified from 1.root.json through every root version
+// to the latest one, and from there through timestamp, snapshot and targets
+// to the delegated roles and the stored targets. Unlike a TUF client it
+// doesn't stop at expired metadata, which is reported as of now instead.
+// Problems with the repository are listed in Inspection.Errors, an error is
+// only returned if the root metadata can't be read.
+func InspectRepo(fsys fs.FS, now time.Time) (*Inspection, error) {
+	in := &Inspection{Roles: []RoleInspection{}, Targets: []TargetInspection{}}
+
+	trusted, _, err := readMetadataFile[metadata.RootType](fsys, "repository/1.root.json")
+	if err != nil {
+		return nil, err
+	}
+	in.check("1.root.json", trusted.VerifyDelegate("root", trusted))
+	for version := trusted.Signed.Version + 1; ; version++ {
+		name := fmt.Sprintf("%d.root.json", version)
+		next, _, err := readMetadataFile[metadata.RootType](fsys, path.Join("repository", name))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if next.Signed.Version != version {
+			in.errorf("%s has version %d", name, next.Signed.Version)
+		}
+		// Every version has to be signed by the keys of the one before and
+		// by its own keys.
+		in.check(name, trusted.VerifyDelegate("root", next))
+		in.check(name, next.VerifyDelegate("root", next))
+		trusted = next
+	}
+	current, _, err := readMetadataFile[metadata.RootType](fsys, "repository/root.json")
+	if err != nil {
+		return nil, err
+	}
+	if current.Signed.Version != trusted.Signed.Version {
+		in.errorf("root.json has version %d, but the latest root version is %d", current.Signed.Version, trusted.Signed.Version)
+	}
+	in.addRole("root", trusted, trusted.Signed.Roles["root"], now)
+
+	timestamp, _, err := readMetadataFile[metadata.TimestampType](fsys, "repository/timestamp.json")
+	if err != nil {
+		in.errorf("%v", err)
+		return in, nil
+	}
+	in.check("timestamp.json", trusted.VerifyDelegate("timestamp", timestamp))
+	in.addRole("timestamp", timestamp, trusted.Signed.Roles["timestamp"], now)
+
+	snapshotMeta, ok := timestamp.Signed.Meta["snapshot.json"]
+	if !ok {
+		in.errorf("timestamp.json does not describe snapshot.json")
+		return in, nil
+	}
+	snapshot, ok := readVerifiedMetadata[metadata.SnapshotType](in, fsys, "snapshot", snapshotMeta)
+	if !ok {
+		return in, nil
+	}
+	in.check("snapshot.json", trusted.VerifyDelegate("snapshot", snapshot))
+	in.addRole("snapshot", snapshot, trusted.Signed.Roles["snapshot"], now)
+
+	targetsMeta, ok := snapshot.Signed.Meta["targets.json"]
+	if !ok {
+		in.errorf("snapshot.json does not describe targets.json")
+		return in, nil
+	}
+	targets, ok := readVerifiedMetadata[metadata.TargetsType](in, fsys, "targets", targetsMeta)
+	if !ok {
+		return in, nil
+	}
+	in.check("targets.json", trusted.VerifyDelegate("targets", targets))
+	in.addRole("targets", targets, trusted.Signed.Roles["targets"], now)
+	in.addTargets(fsys, "targets", targets)
+
+	if targets.Signed.Delegations != nil {
+		for _, role := range targets.Signed.Delegations.Roles {
+			if !delegationNameRegexp.MatchString(role.Name) {
+				in.errorf("unsupported delegated role name %q", role.Name)
+				continue
+			}
+			meta, ok := snapshot.Signed.Meta[role.Name+".json"]
+			if !ok {
+				in.errorf("snapshot.json does not describe %s.json", role.Name)
+				continue
+			}
+			delegated, ok := readVerifiedMetadata[metadata.TargetsType](in, fsys, role.Name, meta)
+			if !ok {
+				continue
+			}
+			in.check(role.Name+".json", targets.VerifyDelegate(role.Name, delegated))
+			in.addRole(role.Name, delegated, &metadata.Role{KeyIDs: role.KeyIDs, Threshold: role.Threshold}, now)
+			in.addTargets(fsys, role.Name, delegated)
+		}
+	}
+	slices.SortFunc(in.Targets, func(a, b TargetInspection) int { return strings.Compare(a.Name, b.Name) })
+	return in, nil
+}
+
+// readVerifiedMetadata reads the version of the metadata of role described by
+// meta, and checks that it matches meta.
+func readVerifiedMetadata[T metadata.Roles](in *Inspection, fsys fs.FS, role string, meta *metadata.MetaFiles) (*metadata.Metadata[T], bool) {
+	name := fmt.Sprintf("%d.%s.json", meta.Version, role)
+	md, content, err := readMetadataFile[T](fsys, path.Join("repository", name))
+	if err != nil {
+		in.errorf("%v", err)
+		return nil, false
+	}
+	if err := meta.VerifyLengthHashes(content); err != nil {
+		in.errorf("%s does not match its length and hashes: %v", name, err)
+	}
+	// The unversioned file is what clients without consistent snapshots
+	// get.
+	if latest, err := fs.ReadFile(fsys, path.Join("repository", role+".json")); err != nil || !bytes.Equal(latest, content) {
+		in.errorf("%s.json is not version %d", role, meta.Version)
+	}
+	return md, true
+}
+
+// check records err as a problem with the metadata file name.
+func (in *Inspection) check(name string, err error) {
+	if err != nil {
+		in.errorf("%s: %v", name, err)
+	}
+}
+
+func (in *Inspection) errorf(format string, args ...any) {
+	in.Errors = append(in.Errors, fmt.Sprintf(format, args...))
+}
+
+// addRole describes the role name with the metadata md, whose keys are
+// delegated by role.
+func (in *Inspection) addRole(name string, md any, role *metadata.Role, now time.Time) {
+	ri := RoleInspection{Name: name, KeyIDs: []string{}}
+	if role != nil {
+		ri.Threshold = role.Threshold
+		ri.KeyIDs = slices.Sorted(slices.Values(role.KeyIDs))
+	}
+	switch md := md.(type) {
+	case *metadata.Metadata[metadata.RootType]:
+		ri.Version, ri.Expires, ri.Signatures = md.Signed.Version, md.Signed.Expires, len(md.Signatures)
+	case *metadata.Metadata[metadata.TimestampType]:
+		ri.Version, ri.Expires, ri.Signatures = md.Signed.Version, md.Signed.Expires, len(md.Signatures)
+	case *metadata.Metadata[metadata.SnapshotType]:
+		ri.Version, ri.Expires, ri.Signatures = md.Signed.Version, md.Signed.Expires, len(md.Signatures)
+	case *metadata.Metadata[metadata.TargetsType]:
+		ri.Version, ri.Expires, ri.Signatures = md.Signed.Version, md.Signed.Expires, len(md.Signatures)
+	}
+	ri.Expired = now.After(ri.Expires)
+	in.Roles = append(in.Roles, ri)
+}
+
+// addTargets describes the targets of the targets role name with the metadata
+// md, and checks the stored targets against it.
+func (in *Inspection) addTargets(fsys fs.FS, name string, md *metadata.Metadata[metadata.TargetsType]) {
+	for targetName, target := range md.Signed.Targets {
+		ti := TargetInspection{Name: targetName, Role: name, Length: target.Length, Hashes: map[string]string{}}
+		for alg, h := range target.Hashes {
+			ti.Hashes[alg] = hex.EncodeToString(h)
+		}
+		if target.Custom != nil {
+			custom := &sigstoreCustomMetadata{}
+			if err := json.Unmarshal(*target.Custom, custom); err != nil {
+				in.errorf("target %s: invalid custom metadata: %v", targetName, err)
+			} else if custom.Sigstore != (CustomMetadata{}) {
+				ti.Sigstore = &custom.Sigstore
+			}
+		}
+		in.Targets = append(in.Targets, ti)
+
+		var content []byte
+		for _, p := range hashedPaths(targetName, target.Hashes) {
+			stored, err := fs.ReadFile(fsys, path.Join("repository", "targets", p))
+			if err != nil {
+				in.errorf("target %s: %v", targetName, err)
+				continue
+			}
+			if err := target.VerifyLengthHashes(stored); err != nil {
+				in.errorf("target %s: %s does not match its length and hashes: %v", targetName, p, err)
+				continue
+			}
+			content = stored
+		}
+		if targetName == "trusted_root.json" && content != nil {
+			tr, err := root.NewTrustedRootFromJSON(content)
+			if err != nil {
+				in.errorf("failed to parse trusted_root.json: %v", err)
+				continue
+			}
+			in.TrustedRoot = inspectTrustedRoot(tr)
+		}
+	}
+}
+
+// inspectTrustedRoot summarizes the entries of tr.
+func inspectTrustedRoot(tr *root.TrustedRoot) *TrustedRootInspection {
+	tri := &TrustedRootInspection{
+		CertificateAuthorities: []AuthorityInspection{},
+		TimestampAuthorities:   []AuthorityInspection{},
+		TransparencyLogs:       inspectLogs(tr.RekorLogs()),
+		CTLogs:                 inspectLogs(tr.CTLogs()),
+	}
+	for _, ca := range tr.FulcioCertificateAuthorities() {
+		if ca, ok := ca.(*root.FulcioCertificateAuthority); ok {
+			ai := AuthorityInspection{URI: ca.URI, ValidFrom: ca.ValidityPeriodStart, ValidUntil: validUntil(ca.ValidityPeriodEnd)}
+			if ca.Root != nil {
+				ai.Subject = ca.Root.Subject.String()
+			}
+			tri.CertificateAuthorities = append(tri.CertificateAuthorities, ai)
+		}
+	}
+	for _, tsa := range tr.TimestampingAuthorities() {
+		if tsa, ok := tsa.(*root.SigstoreTimestampingAuthority); ok {
+			ai := AuthorityInspection{URI: tsa.URI, ValidFrom: tsa.ValidityPeriodStart, ValidUntil: validUntil(tsa.ValidityPeriodEnd)}
+			if tsa.Root != nil {
+				ai.Subject = tsa.Root.Subject.String()
+			}
+			tri.TimestampAuthorities = append(tri.TimestampAuthorities, ai)
+		}
+	}
+	return tri
+}
+
+// inspectLogs describes the transparency logs of trusted_root.json, ordered
+// by base URL and validity.
+func inspectLogs(logs map[string]*root.TransparencyLog) []LogInspection {
+	lis := make([]LogInspection, 0, len(logs))
+	for _, tlog := range logs {
+		lis = append(lis, LogInspection{
+			BaseURL:    tlog.BaseURL,
+			LogID:      hex.EncodeToString(tlog.ID),
+			ValidFrom:  tlog.ValidityPeriodStart,
+			ValidUntil: validUntil(tlog.ValidityPeriodEnd),
+		})
+	}
+	slices.SortFunc(lis, func(a, b LogInspection) int {
+		if c := strings.Compare(a.BaseURL, b.BaseURL); c != 0 {
+			return c
+		}
+		return a.ValidFrom.Compare(b.ValidFrom)
+	})
+	return lis
+}
+
+// validUntil returns the end of a validity period, or nil if it is open.
+func validUntil(end time.Time) *time.Time {
+	if end.IsZero() {
+		return nil
+	}
+	return &end
+}
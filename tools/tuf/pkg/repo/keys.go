@@ -0,0 +1,164 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// persistedKeys mirrors the format go-tuf uses for the files in the keys
+// directory, e.g. keys/root.json.
+type persistedKeys struct {
+	Encrypted bool            `json:"encrypted"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// privateKey mirrors the format go-tuf uses for the private keys in the
+// files in the keys directory.
+type privateKey struct {
+	Type       string          `json:"keytype"`
+	Scheme     string          `json:"scheme,omitempty"`
+	Algorithms []string        `json:"keyid_hash_algorithms,omitempty"`
+	Value      json.RawMessage `json:"keyval"`
+}
+
+// ed25519KeyValue is the value of an Ed25519 privateKey.
+type ed25519KeyValue struct {
+	Public  metadata.HexBytes `json:"public"`
+	Private metadata.HexBytes `json:"private"`
+}
+
+// ecdsaKeyValue is the value of an ECDSA privateKey, the private key is in
+// PEM format.
+type ecdsaKeyValue struct {
+	Private string `json:"private"`
+}
+
+// signingKey is a key the metadata of a role is signed with.
+type signingKey struct {
+	// id is the ID of the key in root.json.
+	id     string
+	signer signature.Signer
+	// private is the key as stored in the keys directory. It is nil for
+	// RoleOptions.Signer, whose private key is held elsewhere.
+	private *privateKey
+}
+
+// generateKey generates a new Ed25519 key, the type of key go-tuf generates.
+func generateKey() (*metadata.Key, *signingKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := json.Marshal(ed25519KeyValue{Public: metadata.HexBytes(pub), Private: metadata.HexBytes(priv)})
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := signature.LoadED25519Signer(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := metadata.KeyFromPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := key.ID()
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &signingKey{
+		id:      id,
+		signer:  signer,
+		private: &privateKey{Type: metadata.KeyTypeEd25519, Scheme: metadata.KeySchemeEd25519, Value: value},
+	}, nil
+}
+
+// loadSigner returns the signer of a private key read from a key file.
+func (k *privateKey) loadSigner() (signature.Signer, error) {
+	switch k.Type {
+	case metadata.KeyTypeEd25519:
+		value := ed25519KeyValue{}
+		if err := json.Unmarshal(k.Value, &value); err != nil {
+			return nil, err
+		}
+		if len(value.Private) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid Ed25519 private key")
+		}
+		return signature.LoadED25519Signer(ed25519.PrivateKey(value.Private))
+	case metadata.KeyTypeECDSA_SHA2_P256, metadata.KeyTypeECDSA_SHA2_P256_COMPAT:
+		value := ecdsaKeyValue{}
+		if err := json.Unmarshal(k.Value, &value); err != nil {
+			return nil, err
+		}
+		priv, err := cryptoutils.UnmarshalPEMToPrivateKey([]byte(value.Private), nil)
+		if err != nil {
+			return nil, err
+		}
+		ecdsaKey, ok := priv.(*ecdsa.PrivateKey)
+		if !ok || ecdsaKey.Curve != elliptic.P256() {
+			return nil, errors.New("invalid ECDSA P-256 private key")
+		}
+		return signature.LoadECDSASigner(ecdsaKey, crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Type)
+	}
+}
+
+// parseKeyFile returns the private keys in the content of a key file.
+func parseKeyFile(content []byte) ([]*privateKey, error) {
+	pk := &persistedKeys{}
+	if err := json.Unmarshal(content, pk); err != nil {
+		return nil, err
+	}
+	if pk.Encrypted {
+		return nil, errors.New("encrypted keys are not supported")
+	}
+	var privKeys []*privateKey
+	if err := json.Unmarshal(pk.Data, &privKeys); err != nil {
+		return nil, err
+	}
+	return privKeys, nil
+}
+
+// marshalKeyFile returns the content of the key file holding the private
+// keys of keys. Keys without a private key are left out.
+func marshalKeyFile(keys []*signingKey) ([]byte, error) {
+	privKeys := []*privateKey{}
+	for _, k := range keys {
+		if k.private != nil {
+			privKeys = append(privKeys, k.private)
+		}
+	}
+	data, err := json.MarshalIndent(privKeys, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.MarshalIndent(&persistedKeys{Data: data}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
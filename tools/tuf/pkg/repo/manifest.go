@@ -0,0 +1,207 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ActiveStatus  = "Active"
+	ExpiredStatus = "Expired"
+
+	RootCertificate         = "root"
+	IntermediateCertificate = "intermediate"
+	LeafCertificate         = "leaf"
+)
+
+// ManifestFileNames are the names a manifest can have in the directory with
+// the files that are added to the TUF repository.
+var ManifestFileNames = []string{"manifest.yaml", "manifest.yml", "manifest.json"}
+
+// Manifest describes the files that are added as targets to the TUF
+// repository, so that their usage doesn't have to be guessed from their
+// names.
+type Manifest struct {
+	Targets []ManifestTarget `json:"targets"`
+}
+
+// ManifestTarget describes a single file of a Manifest.
+type ManifestTarget struct {
+	// Name is the name of the file, and of the resulting target.
+	Name string `json:"name"`
+	// Usage is one of Fulcio, Rekor, CTFE, TSA or Unknown.
+	Usage string `json:"usage"`
+	// Status is either Active (the default) or Expired.
+	Status string `json:"status,omitempty"`
+	// URI is the URI of the service the file belongs to.
+	URI string `json:"uri,omitempty"`
+	// Certificate is the position of a Fulcio or TSA certificate in its
+	// chain, one of root (the default), intermediate or leaf.
+	Certificate string `json:"certificate,omitempty"`
+	// Group names the chain a Fulcio or TSA certificate belongs to, for
+	// when there is more than one Fulcio or TSA instance. Certificates of
+	// instances that aren't grouped explicitly are assigned to the root
+	// certificate that issued them.
+	Group string `json:"group,omitempty"`
+	// ValidFrom and ValidUntil limit the validity of the key or certificate
+	// in trusted_root.json. For certificates they default to the validity of
+	// the first certificate of the chain, for keys the start defaults to the
+	// time the repository is created. Expired keys are valid until the time
+	// the repository is created unless ValidUntil is set.
+	// Certificates with the same group, status and validity window make up
+	// one chain, so retired chains are listed next to the active one.
+	ValidFrom  *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+	// Origin is the origin of a Rekor or CTFE log, which is used to compute
+	// the log ID.
+	Origin string `json:"origin,omitempty"`
+	// BaseURL is the base URL of a Rekor or CTFE log.
+	BaseURL string `json:"baseURL,omitempty"`
+	// APIVersion is the major API version of a Rekor log, which determines
+	// how its log ID is derived. Defaults to the API version of the rekor
+	// service.
+	APIVersion uint32 `json:"apiVersion,omitempty"`
+}
+
+// ParseManifest parses a Manifest in YAML or JSON format and validates it.
+func ParseManifest(b []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := yaml.UnmarshalStrict(b, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) validate() error {
+	seen := map[string]bool{}
+	for _, t := range m.Targets {
+		if t.Name == "" {
+			return errors.New("manifest target without a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("target %s is listed more than once in the manifest", t.Name)
+		}
+		seen[t.Name] = true
+		if !slices.Contains([]string{FulcioTarget, RekorTarget, CTFETarget, TSATarget, UnknownTarget}, t.Usage) {
+			return fmt.Errorf("target %s: unknown usage %q", t.Name, t.Usage)
+		}
+		if !slices.Contains([]string{"", ActiveStatus, ExpiredStatus}, t.Status) {
+			return fmt.Errorf("target %s: unknown status %q", t.Name, t.Status)
+		}
+		switch t.Usage {
+		case FulcioTarget:
+			if !slices.Contains([]string{"", RootCertificate, IntermediateCertificate}, t.Certificate) {
+				return fmt.Errorf("target %s: invalid certificate %q for Fulcio", t.Name, t.Certificate)
+			}
+		case TSATarget:
+			if !slices.Contains([]string{"", RootCertificate, IntermediateCertificate, LeafCertificate}, t.Certificate) {
+				return fmt.Errorf("target %s: invalid certificate %q for TSA", t.Name, t.Certificate)
+			}
+		default:
+			if t.Certificate != "" || t.Group != "" {
+				return fmt.Errorf("target %s: certificate and group are only supported for Fulcio and TSA", t.Name)
+			}
+		}
+		if t.APIVersion != 0 && (t.Usage != RekorTarget || t.APIVersion > 2) {
+			return fmt.Errorf("target %s: apiVersion is only supported for Rekor, as 1 or 2", t.Name)
+		}
+		if t.ValidFrom != nil && t.ValidUntil != nil && !t.ValidFrom.Before(*t.ValidUntil) {
+			return fmt.Errorf("target %s: validFrom must be before validUntil", t.Name)
+		}
+	}
+	return nil
+}
+
+// checkFiles makes sure that the manifest describes exactly the given files.
+func (m *Manifest) checkFiles(files map[string][]byte) error {
+	listed := map[string]bool{}
+	for _, t := range m.Targets {
+		if _, ok := files[t.Name]; !ok {
+			return fmt.Errorf("file %s from the manifest is missing", t.Name)
+		}
+		listed[t.Name] = true
+	}
+	for name := range files {
+		if !listed[name] {
+			return fmt.Errorf("file %s is not listed in the manifest", name)
+		}
+	}
+	return nil
+}
+
+// target returns the manifest entry for the named file.
+func (m *Manifest) target(name string) (ManifestTarget, bool) {
+	for _, t := range m.Targets {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return ManifestTarget{}, false
+}
+
+// status returns the status of the target, defaulting to Active.
+func (t ManifestTarget) status() string {
+	if t.Status == "" {
+		return ActiveStatus
+	}
+	return t.Status
+}
+
+// apiVersion returns the API version of the target, defaulting to the API
+// version of its service.
+func (t ManifestTarget) apiVersion(serviceVersion uint32) uint32 {
+	if t.APIVersion == 0 {
+		return serviceVersion
+	}
+	return t.APIVersion
+}
+
+// manifestFromNames creates a Manifest for the named files by deducing their
+// usage, and the position of certificates in their chain, from the file
+// names. This is what is used when no manifest is given.
+func manifestFromNames(names []string) *Manifest {
+	sort.Strings(names)
+	m := &Manifest{Targets: make([]ManifestTarget, 0, len(names))}
+	for _, name := range names {
+		t := ManifestTarget{Name: name, Usage: getTargetUsage(name)}
+		switch t.Usage {
+		case FulcioTarget:
+			// no leaf for Fulcio certificate, the leaf is the code signing cert
+			if strings.Contains(name, "intermediate") {
+				t.Certificate = IntermediateCertificate
+			}
+		case TSATarget:
+			switch {
+			case strings.Contains(name, "leaf"):
+				t.Certificate = LeafCertificate
+			case strings.Contains(name, "intermediate"):
+				t.Certificate = IntermediateCertificate
+			}
+		}
+		m.Targets = append(m.Targets, t)
+	}
+	return m
+}
@@ -0,0 +1,97 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"testing/fstest"
+)
+
+// MemoryRepo is a TUF repository that only exists in memory, as created by
+// CreateRepoInMemory. Any number of them can be created in the same process.
+type MemoryRepo struct {
+	// fsys holds the repository laid out like the directory returned by
+	// CreateRepoWithOptions.
+	fsys fstest.MapFS
+}
+
+// CreateRepoInMemory is like CreateRepoWithOptions, but the repository and
+// its keys are kept in memory instead of in a temporary directory.
+func CreateRepoInMemory(ctx context.Context, files map[string][]byte, options CreateRepoOptions) (*MemoryRepo, error) {
+	targets, err := constructTargets(files, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	return createRepoInMemory(ctx, targets, options.Roles, options.Delegations)
+}
+
+// CreateRepoWithMetadataInMemory is like CreateRepoWithMetadataAndRoles, but
+// the repository and its keys are kept in memory instead of in a temporary
+// directory.
+func CreateRepoWithMetadataInMemory(ctx context.Context, targets []TargetWithMetadata, roles map[string]RoleOptions) (*MemoryRepo, error) {
+	return createRepoInMemory(ctx, targets, roles, nil)
+}
+
+func createRepoInMemory(ctx context.Context, targets []TargetWithMetadata, roles map[string]RoleOptions, delegations []Delegation) (*MemoryRepo, error) {
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+	if err := validateDelegations(delegations); err != nil {
+		return nil, fmt.Errorf("invalid delegations: %w", err)
+	}
+
+	m := &MemoryRepo{fsys: fstest.MapFS{}}
+	if err := createRepo(ctx, mapFS{m.fsys}, targets, roles, delegations); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetMeta returns the metadata files of the repository by name.
+func (m *MemoryRepo) GetMeta() (map[string]json.RawMessage, error) {
+	return fsStore{m.fsys}.GetMeta()
+}
+
+// FS returns a copy of the contents of the repository laid out like the
+// directory returned by CreateRepoWithOptions: the metadata and the targets
+// are in "repository" and the keys of the roles in "keys". It can be passed
+// to CompressFS directly.
+func (m *MemoryRepo) FS() fs.FS {
+	fsys := fstest.MapFS{}
+	for name, f := range m.fsys {
+		clone := *f
+		clone.Data = bytes.Clone(f.Data)
+		fsys[name] = &clone
+	}
+	return fsys
+}
+
+// KeyFiles returns a copy of the keys of the roles in the format of the files
+// in the keys directory (e.g. "root.json", "targets.json", ...), as expected
+// by LoadRepo.
+func (m *MemoryRepo) KeyFiles() map[string][]byte {
+	keyFiles := map[string][]byte{}
+	for name, f := range m.fsys {
+		if dir, file := path.Split(name); dir == "keys/" {
+			keyFiles[file] = bytes.Clone(f.Data)
+		}
+	}
+	return keyFiles
+}
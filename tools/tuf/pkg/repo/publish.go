@@ -0,0 +1,172 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"knative.dev/pkg/logging"
+)
+
+// versionsDir is the directory in the target directory of Publish that holds
+// the published versions of the repository.
+const versionsDir = ".versions"
+
+// Publish makes the repository compressed with CompressFS available in
+// targetDir/repository. Every version is uncompressed into its own directory
+// next to the current one, and then switched in by replacing the
+// targetDir/repository symlink, so that readers always see one complete
+// version of the repository. Replaced versions are removed once grace has
+// passed, giving clients in the middle of an update time to finish it. The
+// removal happens in the background, unless ctx is done before; versions
+// left over are removed by the next Publish.
+func Publish(ctx context.Context, repository []byte, targetDir string, grace time.Duration) error {
+	versions := filepath.Join(targetDir, versionsDir)
+	if err := os.MkdirAll(versions, 0755); err != nil {
+		return fmt.Errorf("failed to create versions dir: %w", err)
+	}
+	now := time.Now()
+	version := strconv.FormatInt(now.UnixNano(), 10)
+	versionDir := filepath.Join(versions, version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		return fmt.Errorf("failed to create version dir: %w", err)
+	}
+	if err := Uncompress(bytes.NewReader(repository), versionDir); err != nil {
+		os.RemoveAll(versionDir)
+		return fmt.Errorf("failed to uncompress repository: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(versionDir, "repository", "root.json")); err != nil {
+		os.RemoveAll(versionDir)
+		return fmt.Errorf("compressed repository has no root.json: %w", err)
+	}
+
+	if err := switchRepository(targetDir, filepath.Join(versionsDir, version, "repository")); err != nil {
+		return fmt.Errorf("failed to switch to version %s: %w", version, err)
+	}
+	logging.FromContext(ctx).Infof("Published repository version %s in %s", version, targetDir)
+
+	if err := removeOldVersions(ctx, versions, now, grace); err != nil {
+		return err
+	}
+	if grace > 0 {
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(grace):
+				if err := removeOldVersions(ctx, versions, time.Now(), grace); err != nil {
+					logging.FromContext(ctx).Warnf("Failed to remove replaced repository versions: %v", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// switchRepository atomically points the targetDir/repository symlink to
+// target, which is relative to targetDir.
+func switchRepository(targetDir, target string) error {
+	link := filepath.Join(targetDir, "repository")
+	fi, err := os.Lstat(link)
+	legacy := err == nil && fi.Mode()&fs.ModeSymlink == 0
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	tmp := link + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if !legacy {
+		// Renaming over the old symlink is atomic, unlike removing it first.
+		return os.Rename(tmp, link)
+	}
+
+	// The repository was written in place, before versions were published.
+	// Swap it with the symlink, and keep it as version 0 so that it's
+	// removed along with the other old versions.
+	legacyDir := filepath.Join(targetDir, versionsDir, "0")
+	if err := os.RemoveAll(legacyDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(legacyDir, 0755); err != nil {
+		return err
+	}
+	if err := exchange(tmp, link); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(legacyDir, "repository"))
+}
+
+// exchangeByRename swaps the files oldpath and newpath with three renames,
+// so unlike exchange newpath briefly doesn't exist.
+func exchangeByRename(oldpath, newpath string) error {
+	aside := newpath + ".old"
+	if err := os.RemoveAll(aside); err != nil {
+		return err
+	}
+	if err := os.Rename(newpath, aside); err != nil {
+		return err
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return os.Rename(aside, oldpath)
+}
+
+// removeOldVersions removes the versions in the versions dir that were
+// replaced by a newer one more than grace before now. The newest version is
+// always kept.
+func removeOldVersions(ctx context.Context, versions string, now time.Time, grace time.Duration) error {
+	entries, err := os.ReadDir(versions)
+	if err != nil {
+		return fmt.Errorf("failed to list versions: %w", err)
+	}
+	published := []int64{}
+	for _, e := range entries {
+		v, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil || !e.IsDir() {
+			logging.FromContext(ctx).Warnf("Ignoring unexpected entry %s in %s", e.Name(), versions)
+			continue
+		}
+		published = append(published, v)
+	}
+	slices.Sort(published)
+
+	// A version is replaced when the one after it is published.
+	for i := 0; i < len(published)-1; i++ {
+		replaced := time.Unix(0, published[i+1])
+		if now.Sub(replaced) < grace {
+			continue
+		}
+		name := strconv.FormatInt(published[i], 10)
+		logging.FromContext(ctx).Infof("Removing repository version %s", name)
+		if err := os.RemoveAll(filepath.Join(versions, name)); err != nil {
+			return fmt.Errorf("failed to remove version %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"knative.dev/pkg/logging"
+)
+
+// OnlineKeyFiles are the key files of the roles that get re-signed while
+// the repository is being served. Only these are needed by ResignOnlineRoles.
+var OnlineKeyFiles = []string{"snapshot.json", "timestamp.json"}
+
+// ResignOnlineRoles publishes new versions of snapshot.json and timestamp.json
+// for the TUF repository in dir, pushing out their expiration as configured
+// in roles. Only the snapshot and timestamp keys have to be present in the
+// keys directory.
+func ResignOnlineRoles(ctx context.Context, dir string, roles map[string]RoleOptions) (LocalStore, error) {
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+
+	fsys := newDirFS(dir)
+	r, err := openTUFRepo(fsys, roles)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.signOnlineRoles(roles, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := r.write(); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Infof("Re-signed snapshot and timestamp, timestamp is now at version %d expiring %s", r.timestamp.Signed.Version, r.timestamp.Signed.Expires)
+	return fsStore{fsys}, nil
+}
@@ -24,7 +24,9 @@ import (
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
@@ -32,17 +34,22 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"testing/fstest"
 	"time"
 
+	protocommon "github.com/sigstore/protobuf-specs/gen/pb-go/common/v1"
 	prototrustroot "github.com/sigstore/protobuf-specs/gen/pb-go/trustroot/v1"
 	"github.com/sigstore/rekor-tiles/v2/pkg/note"
 	"github.com/sigstore/sigstore-go/pkg/root"
-	"github.com/theupdateframework/go-tuf"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"google.golang.org/protobuf/encoding/protojson"
 	"knative.dev/pkg/logging"
 )
 
@@ -58,6 +65,93 @@ type CreateRepoOptions struct {
 	AddMetadataTargets bool
 	AddTrustedRoot     bool
 	AddSigningConfig   bool
+	// Manifest describes the usage of the files. If nil, it is deduced from
+	// the file names as described in CreateRepoWithOptions.
+	Manifest *Manifest
+	// Services configures the services ("fulcio", "oidc", "rekor", "ctlog"
+	// and "tsa") described in trusted_root.json and signing_config. Services
+	// that are missing get the defaults described in Service.
+	Services map[string]Service
+	// Roles configures the top-level roles ("root", "targets", "snapshot"
+	// and "timestamp"). Roles that are missing get the defaults described in
+	// RoleOptions.
+	Roles map[string]RoleOptions
+	// Delegations configures delegated targets roles, which sign the
+	// targets matching their paths instead of the targets role.
+	Delegations []Delegation
+}
+
+// TopLevelRoles are the top-level TUF roles that can be configured with
+// RoleOptions.
+var TopLevelRoles = []string{"root", "targets", "snapshot", "timestamp"}
+
+// RoleOptions configures the keys and expiration of a TUF role.
+type RoleOptions struct {
+	// Expires is how long the metadata of the role is valid for, defaults to
+	// 6 months.
+	Expires time.Duration
+	// Keys is the number of keys generated for the role, defaults to 1.
+	Keys int
+	// Threshold is the number of signatures required for the role, defaults
+	// to 1.
+	Threshold int
+	// Signer, if set, is the only key of the role instead of generated keys,
+	// e.g. a KMS key loaded with LoadSigner. Its private key is never
+	// written to the keys directory. Only supported for SignerRoles.
+	Signer signature.SignerVerifier
+}
+
+func (o RoleOptions) expires(now time.Time) time.Time {
+	expires := now.Add(o.Expires)
+	if o.Expires == 0 {
+		expires = now.AddDate(0, 6, 0)
+	}
+	// Expiration times in TUF metadata are in UTC, to the second.
+	return expires.UTC().Round(time.Second)
+}
+
+func (o RoleOptions) keys() int {
+	if o.Signer != nil {
+		return 1
+	}
+	return max(o.Keys, 1)
+}
+
+func (o RoleOptions) threshold() int {
+	return max(o.Threshold, 1)
+}
+
+// validateRoles checks that the given role options can be satisfied.
+func validateRoles(roles map[string]RoleOptions) error {
+	for name, o := range roles {
+		if !slices.Contains(TopLevelRoles, name) {
+			return fmt.Errorf("unknown role %q", name)
+		}
+		if err := validateRole(name, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRole checks that the options of the role name can be satisfied.
+func validateRole(name string, o RoleOptions) error {
+	if o.Expires < 0 {
+		return fmt.Errorf("role %s: expiration must not be negative", name)
+	}
+	if o.Keys < 0 || o.Threshold < 0 {
+		return fmt.Errorf("role %s: number of keys and threshold must not be negative", name)
+	}
+	if o.Signer != nil && !slices.Contains(SignerRoles, name) {
+		return fmt.Errorf("role %s: signers are only supported for %s", name, strings.Join(SignerRoles, " and "))
+	}
+	if o.Signer != nil && o.Keys > 1 {
+		return fmt.Errorf("role %s: a role with a signer has a single key", name)
+	}
+	if o.threshold() > o.keys() {
+		return fmt.Errorf("role %s: threshold %d is larger than the number of keys %d", name, o.threshold(), o.keys())
+	}
+	return nil
 }
 
 // TargetWithMetadata describes a TUF target with the given Name, Bytes, and
@@ -80,61 +174,80 @@ type sigstoreCustomMetadata struct {
 
 // CreateRepoWithMetadata will create a TUF repo for Sigstore by adding targets
 // to the Root with custom metadata.
-func CreateRepoWithMetadata(ctx context.Context, targets []TargetWithMetadata) (tuf.LocalStore, string, error) {
-	// TODO: Make this an in-memory fileystem.
-	tmpDir := os.TempDir()
-	dir := path.Join(tmpDir, "tuf")
-	err := os.Mkdir(dir, os.ModePerm)
+func CreateRepoWithMetadata(ctx context.Context, targets []TargetWithMetadata) (LocalStore, string, error) {
+	return CreateRepoWithMetadataAndRoles(ctx, targets, nil)
+}
+
+// CreateRepoWithMetadataAndRoles is like CreateRepoWithMetadata, but the keys
+// and expiration of the top-level roles are configured by roles.
+// The repository is created in a new temporary directory, which is returned
+// and which the caller is responsible for removing.
+func CreateRepoWithMetadataAndRoles(ctx context.Context, targets []TargetWithMetadata, roles map[string]RoleOptions) (LocalStore, string, error) {
+	return CreateRepoWithDelegations(ctx, targets, roles, nil)
+}
+
+// CreateRepoWithDelegations is like CreateRepoWithMetadataAndRoles, but the
+// targets matching the paths of delegations are signed by the delegated roles
+// instead of the targets role.
+func CreateRepoWithDelegations(ctx context.Context, targets []TargetWithMetadata, roles map[string]RoleOptions, delegations []Delegation) (LocalStore, string, error) {
+	if err := validateRoles(roles); err != nil {
+		return nil, "", fmt.Errorf("invalid role options: %w", err)
+	}
+	if err := validateDelegations(delegations); err != nil {
+		return nil, "", fmt.Errorf("invalid delegations: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "tuf")
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to create tmp TUF dir: %w", err)
 	}
-	dir += "/"
 	logging.FromContext(ctx).Infof("Creating the FS in %q", dir)
-	local := tuf.FileSystemStore(dir, nil)
-
-	// Create and commit a new TUF repo with the targets to the store.
-	logging.FromContext(ctx).Infof("Creating new repo in %q", dir)
-	r, err := tuf.NewRepoIndent(local, "", " ")
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to NewRepoIndent: %w", err)
+	fsys := newDirFS(dir)
+	if err := createRepo(ctx, fsys, targets, roles, delegations); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
 	}
+	return fsStore{fsys}, dir, nil
+}
 
-	if err := r.Init(true); err != nil {
-		return nil, "", fmt.Errorf("failed to Init repo: %w", err)
+// createRepo creates a new TUF repo with the targets and delegations in fsys,
+// signs all of its metadata and writes it along with the generated keys.
+func createRepo(ctx context.Context, fsys repoFS, targets []TargetWithMetadata, roles map[string]RoleOptions, delegations []Delegation) error {
+	logging.FromContext(ctx).Infof("Creating new repo")
+	now := time.Now()
+	r, err := newTUFRepo(fsys, roles, nil, now)
+	if err != nil {
+		return err
 	}
-
-	// Make all metadata files expire in 6 months.
-	expires := time.Now().AddDate(0, 6, 0)
-
-	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
-		_, err := r.GenKeyWithExpires(role, expires)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to GenKeyWithExpires: %w", err)
-		}
+	if err := r.addDelegations(delegations, now); err != nil {
+		return err
 	}
-
 	for _, t := range targets {
 		logging.FromContext(ctx).Infof("Adding file: %s", t.Name)
-		if err := writeStagedTarget(dir, t.Name, t.Bytes); err != nil {
-			return nil, "", fmt.Errorf("failed to write staged target %s: %w", t.Name, err)
+		if err := r.addTarget(t.Name, t.Bytes, t.CustomMetadata); err != nil {
+			return fmt.Errorf("failed to add target %s: %w", t.Name, err)
 		}
-		err = r.AddTargetWithExpires(t.Name, t.CustomMetadata, expires)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to add AddTargetWithExpires: %w", err)
+	}
+	for _, role := range append(slices.Clone(TopLevelRoles), r.delegatedRoles()...) {
+		if err := r.saveKeys(role); err != nil {
+			return err
 		}
 	}
-
-	// Snapshot, Timestamp, and Publish the repository.
-	if err := r.SnapshotWithExpires(expires); err != nil {
-		return nil, "", fmt.Errorf("failed to add SnapShotWithExpires: %w", err)
+	if err := r.signRoot(); err != nil {
+		return err
 	}
-	if err := r.TimestampWithExpires(expires); err != nil {
-		return nil, "", fmt.Errorf("failed to add TimestampWithExpires: %w", err)
+	if err := r.signTargets(); err != nil {
+		return err
 	}
-	if err := r.Commit(); err != nil {
-		return nil, "", fmt.Errorf("failed to Commit: %w", err)
+	for _, name := range r.delegatedRoles() {
+		if err := r.signDelegation(name); err != nil {
+			return err
+		}
 	}
-	return local, dir, nil
+	if err := r.signOnlineRoles(roles, now); err != nil {
+		return err
+	}
+	return r.write()
 }
 
 // CreateRepoWithOptions creates and initializes a TUF repo for Sigstore by adding
@@ -155,23 +268,51 @@ func CreateRepoWithMetadata(ctx context.Context, targets []TargetWithMetadata) (
 //   - `tsa` = it will get Usage set to `tsa`.
 //   - Anything else will get set to `Unknown`
 //
+// Instead of relying on the file names, CreateRepoOptions.Manifest can
+// describe the usage and other properties of every file.
+//
 // The targets will be added individually to the TUF repo if CreateRepoOptions.AddMetadataTargets
 // is set to true. The trusted_root.json file will be added if CreateRepoOptions.AddTrustedRoot
 // is set to true. At least one of these has to be true.
-func CreateRepoWithOptions(ctx context.Context, files map[string][]byte, options CreateRepoOptions) (tuf.LocalStore, string, error) {
+//
+// The repository is created in a new temporary directory, which is returned.
+// Use CreateRepoInMemory to create it without touching the filesystem.
+func CreateRepoWithOptions(ctx context.Context, files map[string][]byte, options CreateRepoOptions) (LocalStore, string, error) {
+	targets, err := constructTargets(files, options, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return CreateRepoWithDelegations(ctx, targets, options.Roles, options.Delegations)
+}
+
+// constructTargets creates the TUF targets for files as described in
+// CreateRepoWithOptions. The transparency logs, certificate authorities and
+// services in previous keep their validity periods.
+func constructTargets(files map[string][]byte, options CreateRepoOptions, previous *validityPeriods) ([]TargetWithMetadata, error) {
 	if !options.AddMetadataTargets && !options.AddTrustedRoot {
-		return nil, "", errors.New("failed to create TUF repo: At least one of metadataTargets, trustedRoot must be true")
+		return nil, errors.New("failed to create TUF repo: At least one of metadataTargets, trustedRoot must be true")
+	}
+	if err := validateServices(options.Services); err != nil {
+		return nil, fmt.Errorf("invalid service options: %w", err)
+	}
+
+	manifest := options.Manifest
+	if manifest == nil {
+		manifest = manifestFromNames(slices.Collect(maps.Keys(files)))
+	} else if err := manifest.checkFiles(files); err != nil {
+		return nil, fmt.Errorf("failed to create TUF repo: %w", err)
 	}
 
 	metadataTargets := make([]TargetWithMetadata, 0, len(files))
-	for name, bytes := range files {
-		scmActive, err := json.Marshal(&sigstoreCustomMetadata{Sigstore: CustomMetadata{Usage: getTargetUsage(name), Status: "Active"}})
+	for _, t := range manifest.Targets {
+		scmActive, err := json.Marshal(&sigstoreCustomMetadata{Sigstore: CustomMetadata{Usage: t.Usage, Status: t.status(), URI: t.URI}})
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to marshal custom metadata for %s: %w", name, err)
+			return nil, fmt.Errorf("failed to marshal custom metadata for %s: %w", t.Name, err)
 		}
 		metadataTargets = append(metadataTargets, TargetWithMetadata{
-			Name:           name,
-			Bytes:          bytes,
+			Name:           t.Name,
+			Bytes:          files[t.Name],
 			CustomMetadata: scmActive,
 		})
 	}
@@ -181,99 +322,145 @@ func CreateRepoWithOptions(ctx context.Context, files map[string][]byte, options
 		targets = append(targets, metadataTargets...)
 	}
 	if options.AddTrustedRoot {
-		trustedRootTarget, err := constructTrustedRoot(metadataTargets)
+		trustedRootTarget, err := constructTrustedRootWithManifest(metadataTargets, manifest, options.Services, previous)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to construct trust root: %w", err)
+			return nil, fmt.Errorf("failed to construct trust root: %w", err)
 		}
 		targets = append(targets, *trustedRootTarget)
 	}
 	if options.AddSigningConfig {
-		signingConfigTarget, err := constructSigningConfig()
+		signingConfigTarget, err := constructSigningConfig(options.Services, previous)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to construct signing config: %w", err)
+			return nil, fmt.Errorf("failed to construct signing config: %w", err)
 		}
 		targets = append(targets, *signingConfigTarget)
 	}
-
-	return CreateRepoWithMetadata(ctx, targets)
+	return targets, nil
 }
 
 // CreateRepo calls CreateRepoWithOptions, while setting:
 // * CreateRepoOptions.AddMetadataTargets: true
 // * CreateRepoOptions.AddTrustedRoot: false
-func CreateRepo(ctx context.Context, files map[string][]byte) (tuf.LocalStore, string, error) {
+func CreateRepo(ctx context.Context, files map[string][]byte) (LocalStore, string, error) {
 	return CreateRepoWithOptions(ctx, files, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true})
 }
 
 func constructTrustedRoot(targets []TargetWithMetadata) (*TargetWithMetadata, error) {
-	var fulcioRoot, tsaLeaf, tsaRoot []byte
-	var fulcioIntermed, tsaIntermed [][]byte
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	return constructTrustedRootWithManifest(targets, manifestFromNames(names), nil, nil)
+}
+
+// constructTrustedRootWithManifest creates trusted_root.json from the targets
+// as described by the manifest, for the given services. Logs and chains that
+// are in previous keep their validity periods, unless the manifest sets them.
+func constructTrustedRootWithManifest(targets []TargetWithMetadata, manifest *Manifest, services map[string]Service, previous *validityPeriods) (*TargetWithMetadata, error) {
+	fulcioChains := &certChains{}
+	tsaChains := &certChains{}
 	rekorKeys := map[string]*root.TransparencyLog{}
 	ctlogKeys := map[string]*root.TransparencyLog{}
+	checkpointKeyIDs := map[string][]byte{}
 	now := time.Now()
 
-	// we sort the targets by Name, this results in intermediary certs being sorted correctly,
-	// as long as there is less than 10, which is ok to assume for the purposes of this code
+	// we sort the targets by Name so the output doesn't depend on the order of
+	// the targets, the certificate chains are built by their signatures
 	sort.Slice(targets, func(i, j int) bool {
 		return targets[i].Name < targets[j].Name
 	})
 
 	for _, target := range targets {
+		t, ok := manifest.target(target.Name)
+		if !ok {
+			return nil, fmt.Errorf("target %s is not listed in the manifest", target.Name)
+		}
 		// NOTE: in the below switch, we are able to process whole certificate chains, but we also support
 		// if they're passed in as individual certificates, already split in individual targets
-		switch getTargetUsage(target.Name) {
+		switch t.Usage {
 		case FulcioTarget:
-			switch {
-			// no leaf for Fulcio certificate, the leaf is the code signing cert
-			case strings.Contains(target.Name, "intermediate"):
-				fulcioIntermed = append(fulcioIntermed, target.Bytes)
-			default:
-				fulcioRoot = target.Bytes
+			if err := fulcioChains.add(t, target.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid Fulcio certificate: %w", err)
 			}
 		case TSATarget:
-			switch {
-			case strings.Contains(target.Name, "leaf"):
-				tsaLeaf = target.Bytes
-			case strings.Contains(target.Name, "intermediate"):
-				tsaIntermed = append(tsaIntermed, target.Bytes)
-			default:
-				tsaRoot = target.Bytes
+			if err := tsaChains.add(t, target.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid TSA certificate: %w", err)
 			}
 		case RekorTarget:
-			rekorURL := "rekor.rekor-system.svc"
-			tlinstance, id, err := pubkeyToTransparencyLogInstance(rekorURL, target.Bytes, now)
+			rekor := getService(services, "rekor")
+			origin := rekor.origin()
+			if t.Origin != "" {
+				origin = t.Origin
+			}
+			logType := rekorV2Log
+			if t.apiVersion(rekor.APIVersion) == 1 {
+				logType = rekorV1Log
+			}
+			tlinstance, checkpointKeyID, err := pubkeyToTransparencyLogInstance(logType, origin, target.Bytes, now)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse rekor key: %w", err)
 			}
-			tlinstance.BaseURL = "http://" + rekorURL
+			tlinstance.BaseURL = rekor.URL
+			id := hex.EncodeToString(tlinstance.ID)
+			expiredAt := previous.log(tlinstance, RekorTarget, id, now)
+			applyLogOptions(tlinstance, t, expiredAt)
 			rekorKeys[id] = tlinstance
+			checkpointKeyIDs[id] = checkpointKeyID
 		case CTFETarget:
-			ctlogURL := "ctlog.ctlog-system.svc"
-			tlinstance, id, err := pubkeyToTransparencyLogInstance(ctlogURL, target.Bytes, now)
+			ctlog := getService(services, "ctlog")
+			origin := ctlog.origin()
+			if t.Origin != "" {
+				origin = t.Origin
+			}
+			tlinstance, _, err := pubkeyToTransparencyLogInstance(ctLog, origin, target.Bytes, now)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse ctlog key: %w", err)
 			}
+			tlinstance.BaseURL = ctlog.URL
+			id := hex.EncodeToString(tlinstance.ID)
+			expiredAt := previous.log(tlinstance, CTFETarget, id, now)
+			applyLogOptions(tlinstance, t, expiredAt)
 			ctlogKeys[id] = tlinstance
 		}
 	}
 
-	fulcioChainPem := concatCertChain([]byte{}, fulcioIntermed, fulcioRoot)
 	fulcioAuthorities := []root.CertificateAuthority{}
-	if len(fulcioChainPem) > 0 {
+	fulcioChainList, err := fulcioChains.build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Fulcio certificate chain: %w", err)
+	}
+	for _, chain := range fulcioChainList {
+		fulcioChainPem, err := chain.pem()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Fulcio certificate chain: %w", err)
+		}
 		fulcioAuthority, err := certChainToCertificateAuthority(fulcioChainPem)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse cert chain for Fulcio: %w", err)
 		}
+		ca := fulcioAuthority.(*root.FulcioCertificateAuthority)
+		expiredAt := previous.chain(chainID(ca.Root, ca.Intermediates, nil), ca.ValidityPeriodEnd, now)
+		ca.URI, ca.ValidityPeriodStart, ca.ValidityPeriodEnd = applyChainOptions(ca.URI, ca.ValidityPeriodStart, ca.ValidityPeriodEnd, chain.targets(), expiredAt)
 		fulcioAuthorities = append(fulcioAuthorities, fulcioAuthority)
 	}
 
-	tsaChainPem := concatCertChain(tsaLeaf, tsaIntermed, tsaRoot)
 	tsaAuthorities := []root.TimestampingAuthority{}
-	if len(tsaChainPem) > 0 {
+	tsaChainList, err := tsaChains.build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSA certificate chain: %w", err)
+	}
+	for _, chain := range tsaChainList {
+		tsaChainPem, err := chain.pem()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TSA certificate chain: %w", err)
+		}
 		tsaAuthority, err := certChainToTimestampingAuthority(tsaChainPem)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse cert chain for TSA: %w", err)
 		}
+		tsa := tsaAuthority.(*root.SigstoreTimestampingAuthority)
+		expiredAt := previous.chain(chainID(tsa.Root, tsa.Intermediates, tsa.Leaf), tsa.ValidityPeriodEnd, now)
+		tsa.URI, tsa.ValidityPeriodStart, tsa.ValidityPeriodEnd = applyChainOptions(tsa.URI, tsa.ValidityPeriodStart, tsa.ValidityPeriodEnd, chain.targets(), expiredAt)
 		tsaAuthorities = append(tsaAuthorities, tsaAuthority)
 	}
 
@@ -291,6 +478,9 @@ func constructTrustedRoot(targets []TargetWithMetadata) (*TargetWithMetadata, er
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize TrustedRoot to JSON: %w", err)
 	}
+	if serialized, err = addCheckpointKeyIDs(serialized, checkpointKeyIDs); err != nil {
+		return nil, fmt.Errorf("failed to add checkpoint key IDs to TrustedRoot: %w", err)
+	}
 
 	return &TargetWithMetadata{
 		Name:  "trusted_root.json",
@@ -298,57 +488,31 @@ func constructTrustedRoot(targets []TargetWithMetadata) (*TargetWithMetadata, er
 	}, nil
 }
 
-func constructSigningConfig() (*TargetWithMetadata, error) {
-	validityStart := time.Now()
-	fulcioURL := "http://fulcio.fulcio-system.svc"
-	fulcioServices := []root.Service{
-		{
-			URL:                 fulcioURL,
-			MajorAPIVersion:     1,
-			ValidityPeriodStart: validityStart,
-			Operator:            "test",
-		},
-	}
-	oidcURL := "https://kubernetes.default.svc.cluster.local"
-	oidcServices := []root.Service{
-		{
-			URL:                 oidcURL,
-			MajorAPIVersion:     1,
-			ValidityPeriodStart: validityStart,
-			Operator:            "test",
-		},
-	}
-	rekorURL := "http://rekor.rekor-system.svc"
-	rekorServices := []root.Service{
-		{
-			URL:                 rekorURL,
-			MajorAPIVersion:     2,
-			ValidityPeriodStart: validityStart,
-			Operator:            "test",
-		},
-	}
-	rekorConfig := root.ServiceConfiguration{
-		Selector: prototrustroot.ServiceSelector_ANY,
-	}
-	tsaURL := "http://tsa.tsa-system.svc/api/v1/timestamp"
-	tsaServices := []root.Service{
-		{
-			URL:                 tsaURL,
-			MajorAPIVersion:     1,
-			ValidityPeriodStart: validityStart,
-			Operator:            "test",
-		},
-	}
-	tsaConfig := root.ServiceConfiguration{
-		Selector: prototrustroot.ServiceSelector_ANY,
+// constructSigningConfig creates signing_config.v0.2.json for the given
+// services. Services that are in previous keep their validity start.
+func constructSigningConfig(services map[string]Service, previous *validityPeriods) (*TargetWithMetadata, error) {
+	now := time.Now()
+	signingConfigServices := map[string][]root.Service{}
+	for _, name := range []string{"fulcio", "oidc", "rekor", "tsa"} {
+		service := getService(services, name).signingConfigService()
+		service.ValidityPeriodStart = previous.service(name, service.URL, now)
+		signingConfigServices[name] = []root.Service{service}
+	}
+	rekorConfig, err := getService(services, "rekor").serviceConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rekor selector: %w", err)
+	}
+	tsaConfig, err := getService(services, "tsa").serviceConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tsa selector: %w", err)
 	}
 	signingConfig, err := root.NewSigningConfig(
 		root.SigningConfigMediaType02,
-		fulcioServices,
-		oidcServices,
-		rekorServices,
+		signingConfigServices["fulcio"],
+		signingConfigServices["oidc"],
+		signingConfigServices["rekor"],
 		rekorConfig,
-		tsaServices,
+		signingConfigServices["tsa"],
 		tsaConfig,
 	)
 	if err != nil {
@@ -365,15 +529,92 @@ func constructSigningConfig() (*TargetWithMetadata, error) {
 	}, nil
 }
 
-func pubkeyToTransparencyLogInstance(origin string, keyBytes []byte, tm time.Time) (*root.TransparencyLog, string, error) {
+// applyLogOptions sets the base URL and validity of a transparency log as
+// configured in its manifest entry.
+func applyLogOptions(tlog *root.TransparencyLog, t ManifestTarget, now time.Time) {
+	if t.BaseURL != "" {
+		tlog.BaseURL = t.BaseURL
+	}
+	if t.ValidFrom != nil {
+		tlog.ValidityPeriodStart = *t.ValidFrom
+	}
+	switch {
+	case t.ValidUntil != nil:
+		tlog.ValidityPeriodEnd = *t.ValidUntil
+	case t.status() == ExpiredStatus:
+		tlog.ValidityPeriodEnd = now
+	}
+}
+
+// applyChainOptions returns the URI and validity of a certificate chain as
+// configured in the manifest entries of its certificates.
+func applyChainOptions(uri string, start, end time.Time, chain []ManifestTarget, now time.Time) (string, time.Time, time.Time) {
+	for _, t := range chain {
+		if t.URI != "" {
+			uri = t.URI
+		}
+		if t.ValidFrom != nil {
+			start = *t.ValidFrom
+		}
+		switch {
+		case t.ValidUntil != nil:
+			end = *t.ValidUntil
+		case t.status() == ExpiredStatus && now.Before(end):
+			end = now
+		}
+	}
+	return uri, start, end
+}
+
+// transparencyLogType tells the kinds of transparency logs apart, as they
+// derive their log IDs differently.
+type transparencyLogType int
+
+const (
+	// rekorV1Log is a Rekor v1 log, identified by the SHA-256 of its DER
+	// encoded public key.
+	rekorV1Log transparencyLogType = iota
+	// rekorV2Log is a Rekor v2 (tiles) log, identified by its signed note
+	// key hash, which also depends on the origin of the log.
+	rekorV2Log
+	// ctLog is a certificate transparency log, identified by the SHA-256 of
+	// its DER encoded public key as per RFC 6962.
+	ctLog
+)
+
+// pubkeyToTransparencyLogInstance creates the transparency log for the
+// given key, with its log ID derived as appropriate for the type of the
+// log. It also returns the ID of the key used in checkpoints of the log,
+// which is nil for CT logs since they don't publish checkpoints.
+func pubkeyToTransparencyLogInstance(logType transparencyLogType, origin string, keyBytes []byte, tm time.Time) (*root.TransparencyLog, []byte, error) {
 	der, _ := pem.Decode(keyBytes)
+	if der == nil {
+		return nil, nil, errors.New("no PEM encoded public key found")
+	}
 	key, keyDetails, err := getKeyWithDetails(der.Bytes)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
-	_, logID, err := note.KeyHash(origin, key)
-	if err != nil {
-		return nil, "", err
+
+	var logID, checkpointKeyID []byte
+	switch logType {
+	case rekorV2Log:
+		keyID, keyHash, err := note.KeyHash(origin, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		logID = keyHash
+		checkpointKeyID = binary.BigEndian.AppendUint32(nil, keyID)
+	default:
+		spki, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := sha256.Sum256(spki)
+		logID = hash[:]
+		if logType == rekorV1Log {
+			checkpointKeyID = hash[:4]
+		}
 	}
 
 	return &root.TransparencyLog{
@@ -383,7 +624,23 @@ func pubkeyToTransparencyLogInstance(origin string, keyBytes []byte, tm time.Tim
 		HashFunc:            crypto.SHA256, // we can't get this from the keyBytes, assume SHA256
 		PublicKey:           key,
 		SignatureHashFunc:   keyDetails,
-	}, hex.EncodeToString(logID), nil
+	}, checkpointKeyID, nil
+}
+
+// addCheckpointKeyIDs sets the checkpoint key IDs of the Rekor logs in the
+// serialized TrustedRoot, as root.TransparencyLog has no field for them.
+// checkpointKeyIDs are keyed by the hex encoded log ID.
+func addCheckpointKeyIDs(trustedRoot []byte, checkpointKeyIDs map[string][]byte) ([]byte, error) {
+	tr := &prototrustroot.TrustedRoot{}
+	if err := protojson.Unmarshal(trustedRoot, tr); err != nil {
+		return nil, err
+	}
+	for _, tlog := range tr.GetTlogs() {
+		if keyID := checkpointKeyIDs[hex.EncodeToString(tlog.GetLogId().GetKeyId())]; keyID != nil {
+			tlog.CheckpointKeyId = &protocommon.LogId{KeyId: keyID}
+		}
+	}
+	return protojson.Marshal(tr)
 }
 
 func getKeyWithDetails(key []byte) (crypto.PublicKey, crypto.Hash, error) {
@@ -509,21 +766,6 @@ func certChainToCertificateAuthority(certChainPem []byte) (root.CertificateAutho
 	return ca, nil
 }
 
-func concatCertChain(leaf []byte, intermediate [][]byte, root []byte) []byte {
-	result := []byte{}
-	if len(leaf) > 0 {
-		// for Fulcio, the leaf will always be empty, don't necessarily append an empty newline
-		result = append(result, leaf...)
-		result = append(result, byte('\n'))
-	}
-	for _, intermed := range intermediate {
-		result = append(result, intermed...)
-		result = append(result, byte('\n'))
-	}
-	result = append(result, root...)
-	return result
-}
-
 func getTargetUsage(name string) string {
 	for _, knownTargetType := range []string{FulcioTarget, RekorTarget, CTFETarget, TSATarget} {
 		if strings.Contains(strings.ToLower(name), strings.ToLower(knownTargetType)) {
@@ -534,49 +776,64 @@ func getTargetUsage(name string) string {
 	return UnknownTarget
 }
 
-func writeStagedTarget(dir, path string, data []byte) error {
-	path = filepath.Join(dir, "staged", "targets", path)
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
-	}
-	/* #nosec G306 */
-	return os.WriteFile(path, data, 0644)
-}
+// archiveModTime is the modification time of all the entries of the
+// archives created by CompressFS.
+var archiveModTime = time.Unix(0, 0)
 
 // CompressFS archives a TUF repository so that it can be written to Secret
-// for later use.
+// for later use. The archive only depends on the names and contents of the
+// files: entries are sorted by name and have fixed modification times,
+// ownership and modes, and the gzip header has no name or timestamp. That way
+// archiving the same repository twice gives identical bytes, and the Secret
+// is only updated if the repository changed.
 func CompressFS(fsys fs.FS, buf io.Writer, skipDirs map[string]bool) error {
 	// tar > gzip > buf
 	zr := gzip.NewWriter(buf)
 	tw := tar.NewWriter(zr)
 
+	// WalkDir visits the entries of each directory in lexical order.
 	err := fs.WalkDir(fsys, "repository", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 		// Skip the 'keys' and 'staged' directory
 		if d.IsDir() && skipDirs[d.Name()] {
 			return filepath.SkipDir
 		}
 
-		// Stat the file to get the details of it.
-		fi, err2 := fs.Stat(fsys, file)
-		if err2 != nil {
-			return fmt.Errorf("fs.Stat %s: %w", file, err2)
+		header := &tar.Header{
+			Name:    filepath.ToSlash(file),
+			ModTime: archiveModTime,
 		}
-		header, err2 := tar.FileInfoHeader(fi, file)
-		if err2 != nil {
-			return fmt.Errorf("FileInfoHeader %s: %w", file, err2)
+		switch {
+		case d.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case d.Type().IsRegular():
+			// Stat the file to get the size of it.
+			fi, err := fs.Stat(fsys, file)
+			if err != nil {
+				return fmt.Errorf("fs.Stat %s: %w", file, err)
+			}
+			header.Typeflag = tar.TypeReg
+			header.Mode = 0644
+			header.Size = fi.Size()
+		default:
+			return fmt.Errorf("%s is not a regular file or directory", file)
 		}
-		header.Name = filepath.ToSlash(file)
-		if err2 := tw.WriteHeader(header); err2 != nil {
-			return err
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("WriteHeader %s: %w", file, err)
 		}
 		// For files, write the contents.
 		if !d.IsDir() {
-			data, err2 := fsys.Open(file)
-			if err2 != nil {
-				return fmt.Errorf("opening %s: %w", file, err2)
+			data, err := fsys.Open(file)
+			if err != nil {
+				return fmt.Errorf("opening %s: %w", file, err)
 			}
-			if _, err2 := io.Copy(tw, data); err2 != nil {
-				return fmt.Errorf("copying %s: %w", file, err2)
+			defer data.Close()
+			if _, err := io.Copy(tw, data); err != nil {
+				return fmt.Errorf("copying %s: %w", file, err)
 			}
 		}
 		return nil
@@ -595,25 +852,107 @@ func CompressFS(fsys fs.FS, buf io.Writer, skipDirs map[string]bool) error {
 	return zr.Close()
 }
 
+// Limits of Uncompress. The archive is read from a Secret that may be written
+// by others, so it must not be able to fill up the disk. Repositories are far
+// smaller, as the compressed archive has to fit in a Secret.
+var (
+	// maxUncompressedSize is the maximum total size of the files of an
+	// archive.
+	maxUncompressedSize int64 = 256 << 20
+	// maxUncompressedEntries is the maximum number of files and directories
+	// of an archive.
+	maxUncompressedEntries = 10000
+)
+
 // check for path traversal and correct forward slashes
 func validRelPath(p string) bool {
-	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
+	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") {
 		return false
 	}
-	return true
+	return filepath.IsLocal(filepath.FromSlash(p))
 }
 
 // Uncompress takes a TUF repository that's been compressed with Compress and
-// writes to dst directory.
+// writes to dst directory. Only directories and regular files are supported,
+// which are created with mode 0755 and 0644 respectively whatever their mode
+// in the archive, and the archive must not exceed maxUncompressedSize and
+// maxUncompressedEntries.
 func Uncompress(src io.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	// All files are created through dstRoot, so that they can't escape dst
+	// whatever their names.
+	dstRoot, err := os.OpenRoot(dst)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dst, err)
+	}
+	defer dstRoot.Close()
+
+	return readArchive(src, func(name string, content io.Reader) error {
+		target := filepath.FromSlash(name)
+		// Create directories
+		if content == nil {
+			return dstRoot.MkdirAll(target, 0755)
+		}
+		// Write out files
+		if err := dstRoot.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		fileToWrite, err := dstRoot.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fileToWrite, content); err != nil {
+			fileToWrite.Close()
+			return fmt.Errorf("failed to write file %s: %w", name, err)
+		}
+		if err := fileToWrite.Close(); err != nil {
+			return fmt.Errorf("failed to close file %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// UncompressFS takes a TUF repository that's been compressed with Compress and
+// returns it as an in-memory file system, with the same restrictions as
+// Uncompress.
+func UncompressFS(src io.Reader) (fs.FS, error) {
+	fsys := fstest.MapFS{}
+	err := readArchive(src, func(name string, content io.Reader) error {
+		name = path.Clean(name)
+		if content == nil {
+			fsys[name] = &fstest.MapFile{Mode: fs.ModeDir | 0755, ModTime: archiveModTime}
+			return nil
+		}
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", name, err)
+		}
+		fsys[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: archiveModTime}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// readArchive reads the archive src and calls add for each of its entries
+// with the name of the entry and its contents, or nil for directories. It
+// checks the names, types and limits of the entries for Uncompress and
+// UncompressFS.
+func readArchive(src io.Reader, add func(name string, content io.Reader) error) error {
 	zr, err := gzip.NewReader(src)
 	if err != nil {
 		return err
 	}
+	defer zr.Close()
 	tr := tar.NewReader(zr)
 
 	// uncompress each element
-	for {
+	remaining := maxUncompressedSize
+	for entries := 0; ; entries++ {
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break // End of archive
@@ -621,49 +960,35 @@ func Uncompress(src io.Reader, dst string) error {
 		if err != nil {
 			return err
 		}
-		target := header.Name
+		if entries == maxUncompressedEntries {
+			return fmt.Errorf("tar contains more than %d entries", maxUncompressedEntries)
+		}
 
 		// validate name against path traversal
 		if !validRelPath(header.Name) {
-			return fmt.Errorf("tar contained invalid name error %q", target)
+			return fmt.Errorf("tar contained invalid name error %q", header.Name)
 		}
 
-		// add dst + re-format slashes according to system
-		// #nosec G305
-		// mitigated below
-		target = filepath.Join(dst, header.Name)
-		// this check is to mitigate gosec G305 (zip slip vulnerability)
-		if !strings.HasPrefix(target, filepath.Clean(dst)) {
-			return fmt.Errorf("%s: %s", "content filepath is tainted", header.Name)
-		}
 		// check the type
 		switch header.Typeflag {
-		// Create directories
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, os.ModePerm); err != nil {
-					return err
-				}
-			}
-		// Write out files
-		case tar.TypeReg:
-			fileToWrite, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
+			if err := add(header.Name, nil); err != nil {
 				return err
 			}
-			// copy over contents
-			for {
-				_, err := io.CopyN(fileToWrite, tr, 1024)
-				if err != nil {
-					if errors.Is(err, io.EOF) {
-						break
-					}
-					return err
-				}
+		case tar.TypeReg:
+			if header.Size > remaining {
+				return fmt.Errorf("tar contents exceed %d bytes", maxUncompressedSize)
 			}
-			if err := fileToWrite.Close(); err != nil {
-				return fmt.Errorf("failed to close file %s: %w", target, err)
+			// The reader returns io.ErrUnexpectedEOF if the contents are
+			// shorter than header.Size, and never more than it.
+			if err := add(header.Name, tr); err != nil {
+				return err
 			}
+			remaining -= header.Size
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("tar contains unsupported link %s -> %s", header.Name, header.Linkname)
+		default:
+			return fmt.Errorf("tar contains %s of unsupported type %q", header.Name, header.Typeflag)
 		}
 	}
 	return nil
@@ -15,16 +15,48 @@
 package repo
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	prototrustroot "github.com/sigstore/protobuf-specs/gen/pb-go/trustroot/v1"
+	"github.com/sigstore/rekor-tiles/v2/pkg/note"
 	"github.com/sigstore/scaffolding/tools/tuf/pkg/certs"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	sigstoretuf "github.com/sigstore/sigstore-go/pkg/tuf"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/kms"
 	"github.com/stretchr/testify/require"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/config"
+	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
 )
 
 const (
@@ -118,6 +150,9 @@ U0Vwjeco6zyeh0zBTs9/7gV6AHNQ53xD
       "logId": {
         "keyId": "jOSymJW6Ywhw2zAfvchs+4jsOS+Iux5cOrxTfO+HMCA="
       },
+      "checkpointKeyId": {
+        "keyId": "jOSymA=="
+      },
       "baseUrl": "http://rekor.rekor-system.svc"
     }
   ],
@@ -151,7 +186,7 @@ U0Vwjeco6zyeh0zBTs9/7gV6AHNQ53xD
         }
       },
       "logId": {
-        "keyId": "JX/eVrqxfzwqnRD/d/LwUGjzj5cOdWcU75rFzQDHkBU="
+        "keyId": "X41NrIR7j7s97Q766J624WLwJJQii9J7qwCFIhVRsC8="
       }
     }
   ],
@@ -201,6 +236,101 @@ func TestCreateRepo(t *testing.T) {
 	t.Logf("Got repo meta as: %+v", meta)
 }
 
+func TestCreateRepoInParallel(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, dir, err := CreateRepo(context.Background(), files)
+			if err != nil {
+				t.Fatalf("Failed to CreateRepo: %s", err)
+			}
+			defer os.RemoveAll(dir)
+		})
+	}
+}
+
+func TestCreateRepoInMemory(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	// Repositories in memory are independent of each other.
+	other, err := CreateRepoInMemory(context.Background(), files, CreateRepoOptions{AddTrustedRoot: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoInMemory: %s", err)
+	}
+	local, err := CreateRepoInMemory(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoInMemory: %s", err)
+	}
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+	otherMeta, err := other.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+	if bytes.Equal(meta["root.json"], otherMeta["root.json"]) {
+		t.Errorf("expected repositories with different roots")
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(local.FS(), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	keyFiles := local.KeyFiles()
+	// The key files are a copy, changing them doesn't change the repository.
+	keyFiles["root.json"][0] ^= 0xff
+	if bytes.Equal(keyFiles["root.json"], local.KeyFiles()["root.json"]) {
+		t.Errorf("expected KeyFiles to return a copy of the keys")
+	}
+	keyFiles["root.json"][0] ^= 0xff
+	loadedDir, err := LoadRepo(context.Background(), buf.Bytes(), keyFiles)
+	if err != nil {
+		t.Fatalf("Failed to LoadRepo: %v", err)
+	}
+	defer os.RemoveAll(loadedDir)
+
+	// The keys have to be usable by the repository on disk.
+	if _, err := ResignOnlineRoles(context.Background(), loadedDir, nil); err != nil {
+		t.Fatalf("Failed to ResignOnlineRoles: %v", err)
+	}
+
+	cfg, err := config.New(verifyBaseURL, meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(loadedDir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	for name, content := range files {
+		info, err := c.GetTargetInfo(name)
+		if err != nil {
+			t.Fatalf("Failed to find target %s: %v", name, err)
+		}
+		_, got, err := c.DownloadTarget(info, "", "")
+		if err != nil {
+			t.Fatalf("Failed to download %s: %v", name, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("unexpected contents of %s", name)
+		}
+	}
+}
+
 func TestCompressUncompressFS(t *testing.T) {
 	files := map[string][]byte{
 		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
@@ -259,6 +389,281 @@ func TestCompressUncompressFS(t *testing.T) {
 	}
 }
 
+func TestUncompressFS(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	local, dir, err := CreateRepoWithOptions(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	memFS, err := UncompressFS(&buf)
+	if err != nil {
+		t.Fatalf("Failed to uncompress in memory: %v", err)
+	}
+	memRoot, err := fs.ReadFile(memFS, "repository/root.json")
+	if err != nil {
+		t.Errorf("Failed to read the root roundtripped in memory %v", err)
+	}
+	if !bytes.Equal(meta["root.json"], memRoot) {
+		t.Errorf("Root roundtripped in memory differs:\n%s\n%s", string(meta["root.json"]), string(memRoot))
+	}
+	if err := VerifyRepo(context.Background(), memFS); err != nil {
+		t.Errorf("Failed to VerifyRepo the repository in memory: %v", err)
+	}
+}
+
+func TestCompressFSIsDeterministic(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	_, dir, err := CreateRepo(context.Background(), files)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepo: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	skipDirs := map[string]bool{"keys": true, "staged": true}
+	var first bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &first, skipDirs); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+
+	// The same repository uncompressed elsewhere, with other modification
+	// times and modes.
+	copyDir := t.TempDir()
+	if err := Uncompress(bytes.NewReader(first.Bytes()), copyDir); err != nil {
+		t.Fatalf("Failed to uncompress: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = filepath.WalkDir(copyDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if err := os.Chmod(p, 0600); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(p, later, later)
+	})
+	if err != nil {
+		t.Fatalf("Failed to touch the uncompressed repository: %v", err)
+	}
+	var second bytes.Buffer
+	if err := CompressFS(os.DirFS(copyDir), &second, skipDirs); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("Compressing the same repository gave different archives")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(second.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read gzip header: %v", err)
+	}
+	if !zr.ModTime.IsZero() || zr.Name != "" {
+		t.Errorf("expected a gzip header without name and time, got %+v", zr.Header)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		names = append(names, header.Name)
+		if !header.ModTime.Equal(time.Unix(0, 0)) || header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+			t.Errorf("%s: unexpected header %+v", header.Name, header)
+		}
+		if header.Typeflag == tar.TypeDir && header.Mode != 0755 || header.Typeflag == tar.TypeReg && header.Mode != 0644 {
+			t.Errorf("%s: unexpected mode %o", header.Name, header.Mode)
+		}
+	}
+	// Entries are sorted by name within each directory, and directories come
+	// before their contents.
+	byDirectory := func(a, b string) int {
+		return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/"))
+	}
+	if !slices.IsSortedFunc(names, byDirectory) {
+		t.Errorf("expected sorted entries, got %v", names)
+	}
+}
+
+// tarEntry is an entry of an archive created by compressEntries.
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+// compressEntries creates an archive with the given entries, like the ones
+// created by CompressFS.
+func compressEntries(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		header := e.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(e.content))
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatalf("Failed to WriteHeader: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Failed to Write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUncompressSanitizesModes(t *testing.T) {
+	archive := compressEntries(t, []tarEntry{
+		{header: tar.Header{Name: "repository/", Typeflag: tar.TypeDir, Mode: 0777}},
+		{header: tar.Header{Name: "repository/root.json", Typeflag: tar.TypeReg, Mode: 04777}, content: "{}"},
+		// Directories are created for files without entries for them.
+		{header: tar.Header{Name: "repository/targets/rekor.pub", Typeflag: tar.TypeReg, Mode: 0600}, content: rekorPublicKey},
+	})
+	dir := t.TempDir()
+	if err := Uncompress(bytes.NewReader(archive), dir); err != nil {
+		t.Fatalf("Failed to Uncompress: %v", err)
+	}
+	for name, maxMode := range map[string]os.FileMode{
+		"repository":                   os.ModeDir | 0755,
+		"repository/root.json":         0644,
+		"repository/targets":           os.ModeDir | 0755,
+		"repository/targets/rekor.pub": 0644,
+	} {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", name, err)
+		}
+		// The umask may remove permissions, but never add any.
+		if fi.Mode()&^maxMode != 0 || fi.Mode().Type() != maxMode.Type() {
+			t.Errorf("%s: expected mode within %v, got %v", name, maxMode, fi.Mode())
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "repository", "targets", "rekor.pub"))
+	if err != nil || string(content) != rekorPublicKey {
+		t.Errorf("Failed to read uncompressed rekor.pub: %v", err)
+	}
+}
+
+func TestUncompressRejectsMaliciousArchives(t *testing.T) {
+	file := func(name, content string) tarEntry {
+		return tarEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}, content: content}
+	}
+	tests := []struct {
+		name       string
+		entries    []tarEntry
+		maxSize    int64
+		maxEntries int
+		wantErr    string
+	}{{
+		name:    "parent directory",
+		entries: []tarEntry{file("../evil", "evil")},
+		wantErr: "invalid name",
+	}, {
+		name:    "parent directory after clean",
+		entries: []tarEntry{file("repository/../../evil", "evil")},
+		wantErr: "invalid name",
+	}, {
+		name:    "absolute path",
+		entries: []tarEntry{file("/tmp/evil", "evil")},
+		wantErr: "invalid name",
+	}, {
+		name:    "backslash",
+		entries: []tarEntry{file(`repository\..\..\evil`, "evil")},
+		wantErr: "invalid name",
+	}, {
+		name:    "empty name",
+		entries: []tarEntry{file("", "evil")},
+		wantErr: "invalid name",
+	}, {
+		name: "symlink",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "repository", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+			file("repository/evil", "evil"),
+		},
+		wantErr: "unsupported link",
+	}, {
+		name: "hardlink",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "repository/root.json", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}},
+		},
+		wantErr: "unsupported link",
+	}, {
+		name: "fifo",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "repository/root.json", Typeflag: tar.TypeFifo}},
+		},
+		wantErr: "unsupported type",
+	}, {
+		name: "character device",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "repository/root.json", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+		},
+		wantErr: "unsupported type",
+	}, {
+		name:    "too large",
+		entries: []tarEntry{file("repository/a", "0123456789"), file("repository/b", "0123456789")},
+		maxSize: 15,
+		wantErr: "exceed 15 bytes",
+	}, {
+		name: "too many entries",
+		entries: []tarEntry{
+			{header: tar.Header{Name: "repository/a/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "repository/b/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "repository/c/", Typeflag: tar.TypeDir, Mode: 0755}},
+		},
+		maxEntries: 2,
+		wantErr:    "more than 2 entries",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.maxSize != 0 {
+				defer func(size int64) { maxUncompressedSize = size }(maxUncompressedSize)
+				maxUncompressedSize = tc.maxSize
+			}
+			if tc.maxEntries != 0 {
+				defer func(entries int) { maxUncompressedEntries = entries }(maxUncompressedEntries)
+				maxUncompressedEntries = tc.maxEntries
+			}
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "dst")
+			err := Uncompress(bytes.NewReader(compressEntries(t, tc.entries)), dst)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "evil")); err == nil {
+				t.Errorf("a file was written outside of the destination")
+			}
+		})
+	}
+}
+
 func TestConstructTrustedRoot(t *testing.T) {
 	tsaCerts, err := certs.SplitCertChain([]byte(tsaCertChain), "tsa")
 	if err != nil {
@@ -292,3 +697,1688 @@ func TestConstructTrustedRoot(t *testing.T) {
 
 	require.JSONEq(t, trJSON, actualTr)
 }
+
+func TestCreateRepoWithRoleOptions(t *testing.T) {
+	files := map[string][]byte{
+		"rekor.pub": []byte(rekorPublicKey),
+	}
+	roles := map[string]RoleOptions{
+		"root":      {Keys: 3, Threshold: 2},
+		"timestamp": {Expires: time.Hour},
+	}
+	local, dir, err := CreateRepoWithOptions(context.Background(), files, CreateRepoOptions{AddTrustedRoot: true, Roles: roles})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+
+	root, err := metadata.Root().FromBytes(meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to parse root: %v", err)
+	}
+	if got := root.Signed.Roles["root"]; len(got.KeyIDs) != 3 || got.Threshold != 2 {
+		t.Errorf("expected 3 root keys with threshold 2, got %d keys with threshold %d", len(got.KeyIDs), got.Threshold)
+	}
+	if got := root.Signed.Roles["targets"]; len(got.KeyIDs) != 1 || got.Threshold != 1 {
+		t.Errorf("expected 1 targets key with threshold 1, got %d keys with threshold %d", len(got.KeyIDs), got.Threshold)
+	}
+	if time.Until(root.Signed.Expires) < 24*time.Hour {
+		t.Errorf("root expires too early: %s", root.Signed.Expires)
+	}
+
+	timestamp, err := metadata.Timestamp().FromBytes(meta["timestamp.json"])
+	if err != nil {
+		t.Fatalf("Failed to parse timestamp: %v", err)
+	}
+	if time.Until(timestamp.Signed.Expires) > time.Hour+time.Second {
+		t.Errorf("timestamp expires too late: %s", timestamp.Signed.Expires)
+	}
+
+	roles["targets"] = RoleOptions{Keys: 1, Threshold: 2}
+	if _, _, err := CreateRepoWithOptions(context.Background(), files, CreateRepoOptions{AddTrustedRoot: true, Roles: roles}); err == nil {
+		t.Errorf("expected an error for a threshold larger than the number of keys")
+	}
+}
+
+func TestCreateRepoWithManifest(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio-rekor-bridge.pem": []byte(fulcioRootCert),
+		"log.pub":                 []byte(rekorPublicKey),
+		"old.pub":                 []byte(ctlogPublicKey),
+	}
+	manifest, err := ParseManifest([]byte(`
+targets:
+- name: fulcio-rekor-bridge.pem
+  usage: Fulcio
+  uri: https://fulcio.example.com
+- name: log.pub
+  usage: Rekor
+  origin: rekor.example.com
+  baseURL: https://rekor.example.com
+- name: old.pub
+  usage: CTFE
+  status: Expired
+  validUntil: 2025-01-01T00:00:00Z
+`))
+	if err != nil {
+		t.Fatalf("Failed to ParseManifest: %v", err)
+	}
+
+	targets, err := constructTargets(files, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true, Manifest: manifest}, nil)
+	if err != nil {
+		t.Fatalf("Failed to constructTargets: %v", err)
+	}
+	var trustedRoot *root.TrustedRoot
+	for _, target := range targets {
+		switch target.Name {
+		case "trusted_root.json":
+			if trustedRoot, err = root.NewTrustedRootFromJSON(target.Bytes); err != nil {
+				t.Fatalf("Failed to parse trusted root: %v", err)
+			}
+		case "old.pub":
+			require.JSONEq(t, `{"sigstore":{"usage":"CTFE","status":"Expired","uri":""}}`, string(target.CustomMetadata))
+		case "fulcio-rekor-bridge.pem":
+			require.JSONEq(t, `{"sigstore":{"usage":"Fulcio","status":"Active","uri":"https://fulcio.example.com"}}`, string(target.CustomMetadata))
+		}
+	}
+	if trustedRoot == nil {
+		t.Fatalf("trusted_root.json was not created")
+	}
+
+	cas := trustedRoot.FulcioCertificateAuthorities()
+	if len(cas) != 1 || cas[0].(*root.FulcioCertificateAuthority).URI != "https://fulcio.example.com" {
+		t.Errorf("unexpected Fulcio certificate authorities: %+v", cas)
+	}
+	if len(trustedRoot.RekorLogs()) != 1 {
+		t.Fatalf("expected 1 Rekor log, got %d", len(trustedRoot.RekorLogs()))
+	}
+	for _, tlog := range trustedRoot.RekorLogs() {
+		if tlog.BaseURL != "https://rekor.example.com" {
+			t.Errorf("unexpected Rekor base URL %s", tlog.BaseURL)
+		}
+	}
+	if len(trustedRoot.CTLogs()) != 1 {
+		t.Fatalf("expected 1 CT log, got %d", len(trustedRoot.CTLogs()))
+	}
+	for _, tlog := range trustedRoot.CTLogs() {
+		if !tlog.ValidityPeriodEnd.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected CT log validity end %s", tlog.ValidityPeriodEnd)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		files    map[string][]byte
+	}{
+		{"unknown usage", `targets: [{name: a.pub, usage: Bogus}]`, nil},
+		{"unknown status", `targets: [{name: a.pub, usage: Rekor, status: Revoked}]`, nil},
+		{"certificate of a key", `targets: [{name: a.pub, usage: Rekor, certificate: leaf}]`, nil},
+		{"duplicate target", `targets: [{name: a.pub, usage: Rekor}, {name: a.pub, usage: CTFE}]`, nil},
+		{"unknown field", `targets: [{name: a.pub, usage: Rekor, unknownField: true}]`, nil},
+		// Every file has to be listed in the manifest.
+		{"unlisted file", `targets: [{name: a.pub, usage: Rekor}]`, map[string][]byte{"a.pub": []byte(rekorPublicKey), "unlisted.pub": []byte(rekorPublicKey)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			manifest, err := ParseManifest([]byte(tc.manifest))
+			if err == nil {
+				_, err = constructTargets(tc.files, CreateRepoOptions{AddMetadataTargets: true, Manifest: manifest}, nil)
+			}
+			if err == nil {
+				t.Errorf("expected an error for manifest %s", tc.manifest)
+			}
+		})
+	}
+}
+
+func TestCreateRepoWithServices(t *testing.T) {
+	files := map[string][]byte{
+		"ctfe.pub":  []byte(ctlogPublicKey),
+		"rekor.pub": []byte(rekorPublicKey),
+	}
+	services := map[string]Service{
+		"fulcio": {URL: "https://fulcio.example.com", Operator: "example"},
+		"rekor":  {URL: "https://rekor.example.com/", APIVersion: 1},
+		"ctlog":  {URL: "https://ctlog.example.com"},
+		"tsa":    {Selector: "EXACT", Count: 2},
+	}
+	targets, err := constructTargets(files, CreateRepoOptions{AddTrustedRoot: true, AddSigningConfig: true, Services: services}, nil)
+	if err != nil {
+		t.Fatalf("Failed to constructTargets: %v", err)
+	}
+	var trustedRoot *root.TrustedRoot
+	var signingConfig *root.SigningConfig
+	for _, target := range targets {
+		switch target.Name {
+		case "trusted_root.json":
+			trustedRoot, err = root.NewTrustedRootFromJSON(target.Bytes)
+		case "signing_config.v0.2.json":
+			signingConfig, err = root.NewSigningConfigFromJSON(target.Bytes)
+		}
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", target.Name, err)
+		}
+	}
+
+	for _, tlog := range trustedRoot.RekorLogs() {
+		if tlog.BaseURL != "https://rekor.example.com/" {
+			t.Errorf("unexpected Rekor base URL %s", tlog.BaseURL)
+		}
+		_, logID, err := note.KeyHash("rekor.example.com", tlog.PublicKey)
+		if err != nil {
+			t.Fatalf("Failed to compute log ID: %v", err)
+		}
+		if !bytes.Equal(tlog.ID, logID) {
+			t.Errorf("Rekor log ID was not computed from the origin")
+		}
+	}
+	for _, tlog := range trustedRoot.CTLogs() {
+		if tlog.BaseURL != "https://ctlog.example.com" {
+			t.Errorf("unexpected CT log base URL %s", tlog.BaseURL)
+		}
+	}
+
+	fulcio := signingConfig.FulcioCertificateAuthorityURLs()
+	if len(fulcio) != 1 || fulcio[0].URL != "https://fulcio.example.com" || fulcio[0].Operator != "example" || fulcio[0].MajorAPIVersion != 1 {
+		t.Errorf("unexpected Fulcio services: %+v", fulcio)
+	}
+	rekor := signingConfig.RekorLogURLs()
+	if len(rekor) != 1 || rekor[0].URL != "https://rekor.example.com/" || rekor[0].MajorAPIVersion != 1 || rekor[0].Operator != "test" {
+		t.Errorf("unexpected Rekor services: %+v", rekor)
+	}
+	if oidc := signingConfig.OIDCProviderURLs(); len(oidc) != 1 || oidc[0].URL != "https://kubernetes.default.svc.cluster.local" {
+		t.Errorf("unexpected OIDC providers: %+v", oidc)
+	}
+	if config := signingConfig.TimestampAuthorityURLsConfig(); config.Selector != prototrustroot.ServiceSelector_EXACT || config.Count != 2 {
+		t.Errorf("unexpected TSA selector: %+v", config)
+	}
+
+	for _, invalid := range []map[string]Service{
+		{"bogus": {URL: "https://bogus.example.com"}},
+		{"fulcio": {Selector: "ALL"}},
+		{"fulcio": {Origin: "fulcio.example.com"}},
+		{"rekor": {Selector: "SOME"}},
+		{"rekor": {Selector: "EXACT"}},
+		{"tsa": {Count: 1}},
+	} {
+		if _, err := constructTargets(files, CreateRepoOptions{AddTrustedRoot: true, Services: invalid}, nil); err == nil {
+			t.Errorf("expected an error for services %+v", invalid)
+		}
+	}
+}
+
+func TestPubkeyToTransparencyLogInstance(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: spki})
+	spkiHash := sha256.Sum256(spki)
+	noteKeyID, noteLogID, err := note.KeyHash("rekor.example.com", pub)
+	if err != nil {
+		t.Fatalf("Failed to compute key hash: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		logType         transparencyLogType
+		logID           []byte
+		checkpointKeyID []byte
+	}{
+		{"rekor v1", rekorV1Log, spkiHash[:], spkiHash[:4]},
+		{"rekor v2", rekorV2Log, noteLogID, binary.BigEndian.AppendUint32(nil, noteKeyID)},
+		{"ctlog", ctLog, spkiHash[:], nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tlog, checkpointKeyID, err := pubkeyToTransparencyLogInstance(tc.logType, "rekor.example.com", keyPEM, time.Now())
+			if err != nil {
+				t.Fatalf("Failed to create transparency log: %v", err)
+			}
+			if !bytes.Equal(tlog.ID, tc.logID) {
+				t.Errorf("unexpected log ID %x, expected %x", tlog.ID, tc.logID)
+			}
+			if !bytes.Equal(checkpointKeyID, tc.checkpointKeyID) {
+				t.Errorf("unexpected checkpoint key ID %x, expected %x", checkpointKeyID, tc.checkpointKeyID)
+			}
+		})
+	}
+}
+
+func TestConstructTrustedRootWithHistory(t *testing.T) {
+	tsaCerts, err := certs.SplitCertChain([]byte(tsaCertChain), "tsa")
+	if err != nil {
+		t.Fatalf("Failed to split TSA cert chain: %v", err)
+	}
+	files := map[string][]byte{
+		"fulcio.crt.pem":     []byte(fulcioRootCert),
+		"fulcio-old.crt.pem": tsaCerts["tsa_root.crt.pem"],
+		"rekor.pub":          []byte(rekorPublicKey),
+		"rekor-old.pub":      []byte(ctlogPublicKey),
+	}
+	retired := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	manifest := &Manifest{Targets: []ManifestTarget{
+		{Name: "fulcio.crt.pem", Usage: FulcioTarget},
+		{Name: "fulcio-old.crt.pem", Usage: FulcioTarget, Status: ExpiredStatus, ValidUntil: &retired},
+		{Name: "rekor.pub", Usage: RekorTarget},
+		{Name: "rekor-old.pub", Usage: RekorTarget, Status: ExpiredStatus, ValidUntil: &retired, APIVersion: 1},
+	}}
+	targets, err := constructTargets(files, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true, Manifest: manifest}, nil)
+	if err != nil {
+		t.Fatalf("Failed to constructTargets: %v", err)
+	}
+
+	var trustedRoot *root.TrustedRoot
+	for _, target := range targets {
+		switch target.Name {
+		case "trusted_root.json":
+			if trustedRoot, err = root.NewTrustedRootFromJSON(target.Bytes); err != nil {
+				t.Fatalf("Failed to parse trusted root: %v", err)
+			}
+		case "fulcio-old.crt.pem", "rekor-old.pub":
+			if !strings.Contains(string(target.CustomMetadata), `"status":"Expired"`) {
+				t.Errorf("%s is not marked as expired: %s", target.Name, target.CustomMetadata)
+			}
+		}
+	}
+
+	cas := trustedRoot.FulcioCertificateAuthorities()
+	if len(cas) != 2 {
+		t.Fatalf("expected an active and a retired Fulcio CA, got %d", len(cas))
+	}
+	retiredCAs := 0
+	for _, ca := range cas {
+		if ca.(*root.FulcioCertificateAuthority).ValidityPeriodEnd.Equal(retired) {
+			retiredCAs++
+		}
+	}
+	if retiredCAs != 1 {
+		t.Errorf("expected 1 retired Fulcio CA, got %d", retiredCAs)
+	}
+
+	logs := trustedRoot.RekorLogs()
+	if len(logs) != 2 {
+		t.Fatalf("expected an active and a retired Rekor log, got %d", len(logs))
+	}
+	retiredLogs := 0
+	for _, tlog := range logs {
+		switch {
+		case tlog.ValidityPeriodEnd.Equal(retired):
+			retiredLogs++
+		case !tlog.ValidityPeriodEnd.IsZero():
+			t.Errorf("active Rekor log has an end of validity %s", tlog.ValidityPeriodEnd)
+		}
+	}
+	if retiredLogs != 1 {
+		t.Errorf("expected 1 retired Rekor log, got %d", retiredLogs)
+	}
+}
+
+func TestConstructTrustedRootWithMultipleChains(t *testing.T) {
+	tsaCerts, err := certs.SplitCertChain([]byte(tsaCertChain), "tsa")
+	if err != nil {
+		t.Fatalf("Failed to split TSA cert chain: %v", err)
+	}
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem":  []byte(fulcioRootCert),
+		"fulcio_v2.crt.pem":  tsaCerts["tsa_root.crt.pem"],
+		"tsa_root.crt.pem":   tsaCerts["tsa_root.crt.pem"],
+		"tsa_root_2.crt.pem": []byte(fulcioRootCert),
+	}
+	maps.Copy(files, tsaCerts)
+	orphaned := maps.Clone(files)
+	delete(orphaned, "tsa_intermediate_0.crt.pem")
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string][]byte
+		manifest *Manifest
+		wantErr  string
+	}{{
+		// Without a manifest, the TSA certificates are assigned to the root
+		// that issued them.
+		name:  "by issuer",
+		files: files,
+	}, {
+		name:  "by group",
+		files: files,
+		manifest: &Manifest{Targets: []ManifestTarget{
+			{Name: "fulcio_v1.crt.pem", Usage: FulcioTarget, Group: "a"},
+			{Name: "fulcio_v2.crt.pem", Usage: FulcioTarget, Group: "b"},
+			{Name: "tsa_leaf.crt.pem", Usage: TSATarget, Certificate: LeafCertificate, Group: "a"},
+			{Name: "tsa_intermediate_0.crt.pem", Usage: TSATarget, Certificate: IntermediateCertificate, Group: "a"},
+			{Name: "tsa_root.crt.pem", Usage: TSATarget, Group: "a"},
+			{Name: "tsa_root_2.crt.pem", Usage: TSATarget, Group: "b"},
+		}},
+	}, {
+		// A certificate that wasn't issued by any of the roots is an error.
+		name:    "orphaned leaf",
+		files:   orphaned,
+		wantErr: "tsa_leaf.crt.pem",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := constructTargets(tc.files, CreateRepoOptions{AddTrustedRoot: true, Manifest: tc.manifest}, nil)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to constructTargets: %v", err)
+			}
+			var trustedRoot *root.TrustedRoot
+			for _, target := range targets {
+				if target.Name == "trusted_root.json" {
+					if trustedRoot, err = root.NewTrustedRootFromJSON(target.Bytes); err != nil {
+						t.Fatalf("Failed to parse trusted root: %v", err)
+					}
+				}
+			}
+			if trustedRoot == nil {
+				t.Fatalf("trusted_root.json was not created")
+			}
+			if n := len(trustedRoot.FulcioCertificateAuthorities()); n != 2 {
+				t.Errorf("expected 2 Fulcio CAs, got %d", n)
+			}
+			tsas := trustedRoot.TimestampingAuthorities()
+			if len(tsas) != 2 {
+				t.Fatalf("expected 2 TSAs, got %d", len(tsas))
+			}
+			for _, tsa := range tsas {
+				tsa := tsa.(*root.SigstoreTimestampingAuthority)
+				if tsa.Leaf != nil && len(tsa.Intermediates) != 1 {
+					t.Errorf("TSA chain was not linked correctly: %+v", tsa)
+				}
+			}
+		})
+	}
+}
+
+func TestConstructTrustedRootBuildsChainsBySignature(t *testing.T) {
+	root0, intermediates := newTestCertChain(t, 11)
+	otherRoot, otherIntermediates := newTestCertChain(t, 1)
+
+	files := map[string][]byte{"fulcio_root.crt.pem": root0}
+	for i, intermediate := range intermediates {
+		// Lexically intermediate_10 sorts before intermediate_2.
+		files[fmt.Sprintf("fulcio_intermediate_%d.crt.pem", i)] = intermediate
+	}
+	// An intermediate of another chain is orphaned.
+	orphaned := maps.Clone(files)
+	orphaned["fulcio_intermediate_other.crt.pem"] = otherIntermediates[0]
+
+	for _, tc := range []struct {
+		name    string
+		files   map[string][]byte
+		chain   int
+		wantErr string
+	}{
+		{name: "separate files", files: files, chain: 12},
+		{name: "orphaned intermediate", files: orphaned, wantErr: "fulcio_intermediate_other.crt.pem"},
+		// A bundle has to be ordered from the leaf to the root.
+		{name: "ordered bundle", files: map[string][]byte{"fulcio.crt.pem": bytes.Join([][]byte{otherIntermediates[0], otherRoot}, []byte("\n"))}, chain: 2},
+		{name: "out of order bundle", files: map[string][]byte{"fulcio.crt.pem": bytes.Join([][]byte{otherRoot, otherIntermediates[0]}, []byte("\n"))}, wantErr: "out of order"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, err := constructTargets(tc.files, CreateRepoOptions{AddTrustedRoot: true}, nil)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to constructTargets: %v", err)
+			}
+			var trustedRoot *root.TrustedRoot
+			for _, target := range targets {
+				if target.Name == "trusted_root.json" {
+					if trustedRoot, err = root.NewTrustedRootFromJSON(target.Bytes); err != nil {
+						t.Fatalf("Failed to parse trusted root: %v", err)
+					}
+				}
+			}
+			if trustedRoot == nil {
+				t.Fatalf("trusted_root.json was not created")
+			}
+			cas := trustedRoot.FulcioCertificateAuthorities()
+			if len(cas) != 1 {
+				t.Fatalf("expected 1 Fulcio CA, got %d", len(cas))
+			}
+			ca := cas[0].(*root.FulcioCertificateAuthority)
+			chain := append(slices.Clone(ca.Intermediates), ca.Root)
+			if len(chain) != tc.chain {
+				t.Fatalf("expected %d certificates, got %d", tc.chain, len(chain))
+			}
+			for i := 0; i < len(chain)-1; i++ {
+				if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+					t.Errorf("certificate %d is not issued by certificate %d: %v", i, i+1, err)
+				}
+			}
+		})
+	}
+}
+
+// newTestCertChain creates a root certificate and n intermediates, each one
+// issued by the one before it, in PEM format.
+func newTestCertChain(t *testing.T, n int) ([]byte, [][]byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	intermediates := make([][]byte, 0, n)
+	parent, parentKey := template, key
+	for i := 0; i < n; i++ {
+		childKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		child := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 2)),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("intermediate %d", i)},
+			NotBefore:             template.NotBefore,
+			NotAfter:              template.NotAfter,
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, child, parent, childKey.Public(), parentKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %v", err)
+		}
+		intermediates = append(intermediates, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		parent, parentKey = child, childKey
+	}
+	return rootPEM, intermediates
+}
+
+func TestRotateRoot(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	local, dir, err := CreateRepo(context.Background(), files)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepo: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+	oldRoot := meta["root.json"]
+	// readKeys returns the contents of the key files of the repository in
+	// dir by name.
+	readKeys := func(dir string) map[string][]byte {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+		if err != nil {
+			t.Fatalf("Failed to read keys dir: %v", err)
+		}
+		keyFiles := map[string][]byte{}
+		for _, e := range entries {
+			if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+				t.Fatalf("Failed to read key file: %v", err)
+			}
+		}
+		return keyFiles
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	loadedDir, err := LoadRepo(context.Background(), buf.Bytes(), readKeys(dir))
+	if err != nil {
+		t.Fatalf("Failed to LoadRepo: %v", err)
+	}
+	defer os.RemoveAll(loadedDir)
+
+	if _, err := RotateRoot(context.Background(), loadedDir, nil); err != nil {
+		t.Fatalf("Failed to RotateRoot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(loadedDir, "repository", "2.root.json")); err != nil {
+		t.Fatalf("2.root.json was not published: %v", err)
+	}
+
+	// A client that only trusts the old root must be able to update to the
+	// new one.
+	cfg, err := config.New(verifyBaseURL, oldRoot)
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(loadedDir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	if c.GetTrustedMetadataSet().Root.Signed.Version != 2 {
+		t.Errorf("expected the client to update to root version 2")
+	}
+
+	// Only the new root keys should be left.
+	rotatedKeys := readKeys(loadedDir)
+	if bytes.Equal(rotatedKeys["root.json"], readKeys(dir)["root.json"]) {
+		t.Errorf("root keys were not rotated")
+	}
+	if n := strings.Count(string(rotatedKeys["root.json"]), `"keytype"`); n != 1 {
+		t.Errorf("expected 1 root key after rotation, got %d", n)
+	}
+}
+
+func TestLoadRepoRemovesDirOnError(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	_, dir, err := CreateRepo(context.Background(), map[string][]byte{"rekor.pub": []byte(rekorPublicKey)})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepo: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove repo: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		repository []byte
+		keyFiles   map[string][]byte
+	}{
+		"invalid archive":       {repository: []byte("invalid")},
+		"invalid key file name": {repository: buf.Bytes(), keyFiles: map[string][]byte{"../root.json": nil}},
+	} {
+		if _, err := LoadRepo(context.Background(), tc.repository, tc.keyFiles); err == nil {
+			t.Errorf("%s: expected LoadRepo to fail", name)
+		}
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("Failed to read tmp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the directories of failed loads to be removed, got %v", entries)
+	}
+}
+
+func TestResignOnlineRoles(t *testing.T) {
+	files := map[string][]byte{
+		"rekor.pub": []byte(rekorPublicKey),
+	}
+	local, dir, err := CreateRepo(context.Background(), files)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepo: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	// Only hand over the online keys.
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	onlineKeys := map[string][]byte{}
+	for _, name := range OnlineKeyFiles {
+		onlineKeys[name] = keyFiles[name]
+	}
+	loadedDir, err := LoadRepo(context.Background(), buf.Bytes(), onlineKeys)
+	if err != nil {
+		t.Fatalf("Failed to LoadRepo: %v", err)
+	}
+	defer os.RemoveAll(loadedDir)
+
+	if _, err := ResignOnlineRoles(context.Background(), loadedDir, nil); err != nil {
+		t.Fatalf("Failed to ResignOnlineRoles: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(loadedDir, "repository", "2.snapshot.json")); err != nil {
+		t.Fatalf("2.snapshot.json was not published: %v", err)
+	}
+
+	cfg, err := config.New(verifyBaseURL, meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(loadedDir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	if v := c.GetTrustedMetadataSet().Timestamp.Signed.Version; v != 2 {
+		t.Errorf("expected timestamp version 2, got %d", v)
+	}
+}
+
+func TestUpdateRepoWithOptions(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	local, dir, err := CreateRepo(context.Background(), files)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepo: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	loadedDir, err := LoadRepo(context.Background(), buf.Bytes(), keyFiles)
+	if err != nil {
+		t.Fatalf("Failed to LoadRepo: %v", err)
+	}
+	defer os.RemoveAll(loadedDir)
+
+	// Re-adding the same targets should not publish new versions.
+	unchanged, err := constructTargets(files, CreateRepoOptions{AddMetadataTargets: true}, nil)
+	if err != nil {
+		t.Fatalf("Failed to constructTargets: %v", err)
+	}
+	if _, err := UpdateTargets(context.Background(), loadedDir, unchanged, nil, nil); err != nil {
+		t.Fatalf("Failed to UpdateTargets: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(loadedDir, "repository", "2.targets.json")); err == nil {
+		t.Fatalf("2.targets.json was published without any changes")
+	}
+
+	// Replace the rekor key and drop the ctlog key.
+	updated := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"rekor.pub":         []byte(ctlogPublicKey),
+	}
+	if _, err := UpdateRepoWithOptions(context.Background(), loadedDir, updated, CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true}); err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+
+	// A client that trusts the original root must see the updated targets.
+	cfg, err := config.New(verifyBaseURL, meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(loadedDir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	targets := c.GetTopLevelTargets()
+	if _, ok := targets["ctfe.pub"]; ok {
+		t.Errorf("ctfe.pub was not removed")
+	}
+	if _, ok := targets["fulcio_v1.crt.pem"]; !ok {
+		t.Errorf("fulcio_v1.crt.pem is missing")
+	}
+	if v := c.GetTrustedMetadataSet().Targets["targets"].Signed.Version; v != 2 {
+		t.Errorf("expected targets version 2, got %d", v)
+	}
+	info, err := c.GetTargetInfo("rekor.pub")
+	if err != nil {
+		t.Fatalf("Failed to find target rekor.pub: %v", err)
+	}
+	_, content, err := c.DownloadTarget(info, "", "")
+	if err != nil {
+		t.Fatalf("Failed to download rekor.pub: %v", err)
+	}
+	if string(content) != ctlogPublicKey {
+		t.Errorf("rekor.pub was not replaced, got %s", content)
+	}
+
+	if _, err := UpdateTargets(context.Background(), loadedDir, nil, []string{"missing.pub"}, nil); err == nil {
+		t.Errorf("expected an error removing a missing target")
+	}
+}
+
+func TestUpdateRepoKeepsValidityPeriods(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	manifest, err := ParseManifest([]byte(`
+targets:
+- {name: fulcio_v1.crt.pem, usage: Fulcio}
+- {name: ctfe.pub, usage: CTFE, status: Expired}
+- {name: rekor.pub, usage: Rekor}
+`))
+	if err != nil {
+		t.Fatalf("Failed to ParseManifest: %v", err)
+	}
+	options := CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true, AddSigningConfig: true, Manifest: manifest}
+	_, dir, err := CreateRepoWithOptions(context.Background(), files, options)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	if err := CompressFS(os.DirFS(dir), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	loadedDir, err := LoadRepo(context.Background(), buf.Bytes(), keyFiles)
+	if err != nil {
+		t.Fatalf("Failed to LoadRepo: %v", err)
+	}
+	defer os.RemoveAll(loadedDir)
+	read := func(name string) []byte {
+		b, err := readTarget(os.DirFS(loadedDir), name)
+		if err != nil || b == nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return b
+	}
+	trustedRoot, signingConfig := read("trusted_root.json"), read("signing_config.v0.2.json")
+
+	// Updating with the same inputs must not move the validity periods, so
+	// nothing is published.
+	if _, err := UpdateRepoWithOptions(context.Background(), loadedDir, files, options); err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+	if got := read("trusted_root.json"); !bytes.Equal(got, trustedRoot) {
+		t.Errorf("trusted_root.json changed:\n%s\n%s", trustedRoot, got)
+	}
+	if got := read("signing_config.v0.2.json"); !bytes.Equal(got, signingConfig) {
+		t.Errorf("signing_config.v0.2.json changed:\n%s\n%s", signingConfig, got)
+	}
+	if _, err := os.Stat(filepath.Join(loadedDir, "repository", "2.targets.json")); err == nil {
+		t.Errorf("2.targets.json was published without any changes")
+	}
+
+	// Logs that are kept keep their validity when another log is added.
+	before, err := root.NewTrustedRootFromJSON(trustedRoot)
+	if err != nil {
+		t.Fatalf("Failed to parse trusted root: %v", err)
+	}
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	newKeyPEM, err := cryptoutils.MarshalPublicKeyToPEM(newKey.Public())
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	files["rekor_new.pub"] = newKeyPEM
+	manifest.Targets = append(manifest.Targets, ManifestTarget{Name: "rekor_new.pub", Usage: RekorTarget})
+	if _, err := UpdateRepoWithOptions(context.Background(), loadedDir, files, options); err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+	after, err := root.NewTrustedRootFromJSON(read("trusted_root.json"))
+	if err != nil {
+		t.Fatalf("Failed to parse trusted root: %v", err)
+	}
+	if len(after.RekorLogs()) != 2 {
+		t.Fatalf("expected 2 rekor logs, got %d", len(after.RekorLogs()))
+	}
+	for _, logs := range []struct {
+		before, after map[string]*root.TransparencyLog
+	}{
+		{before.RekorLogs(), after.RekorLogs()},
+		{before.CTLogs(), after.CTLogs()},
+	} {
+		for id, l := range logs.before {
+			got := logs.after[id]
+			if !got.ValidityPeriodStart.Equal(l.ValidityPeriodStart) || !got.ValidityPeriodEnd.Equal(l.ValidityPeriodEnd) {
+				t.Errorf("validity of log %s changed from %s-%s to %s-%s", id, l.ValidityPeriodStart, l.ValidityPeriodEnd, got.ValidityPeriodStart, got.ValidityPeriodEnd)
+			}
+		}
+	}
+}
+
+// fakeKMSSigner is a KMS signer backed by a local key.
+type fakeKMSSigner struct {
+	signature.SignerVerifier
+}
+
+func (fakeKMSSigner) CreateKey(context.Context, string) (crypto.PublicKey, error) {
+	return nil, errors.New("not supported")
+}
+
+func (fakeKMSSigner) CryptoSigner(context.Context, func(error)) (crypto.Signer, crypto.SignerOpts, error) {
+	return nil, nil, errors.New("not supported")
+}
+
+func (fakeKMSSigner) SupportedAlgorithms() []string { return nil }
+
+func (fakeKMSSigner) DefaultAlgorithm() string { return "" }
+
+func TestCreateRepoWithSigners(t *testing.T) {
+	files := map[string][]byte{
+		"rekor.pub": []byte(rekorPublicKey),
+	}
+	// An encrypted key file for targets, and an Ed25519 key in a KMS for root.
+	password := []byte("hunter2")
+	privPEM, _, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(), cryptoutils.StaticPasswordFunc(password))
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "targets.key")
+	if err := os.WriteFile(keyPath, privPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if _, err := LoadSigner(context.Background(), keyPath, cryptoutils.StaticPasswordFunc([]byte("wrong"))); err == nil {
+		t.Errorf("expected LoadSigner to fail with the wrong password")
+	}
+	targetsSigner, err := LoadSigner(context.Background(), keyPath, cryptoutils.StaticPasswordFunc(password))
+	if err != nil {
+		t.Fatalf("Failed to LoadSigner: %v", err)
+	}
+	_, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	kms.AddProvider("fakekms://", func(_ context.Context, ref string, _ crypto.Hash, _ ...signature.RPCOption) (kms.SignerVerifier, error) {
+		if ref != "fakekms://root" {
+			return nil, fmt.Errorf("unknown key %s", ref)
+		}
+		sv, err := signature.LoadED25519SignerVerifier(rootKey)
+		return fakeKMSSigner{sv}, err
+	})
+	rootSigner, err := LoadSigner(context.Background(), "fakekms://root", nil)
+	if err != nil {
+		t.Fatalf("Failed to LoadSigner: %v", err)
+	}
+	if _, err := LoadSigner(context.Background(), "fakekms://other", nil); err == nil {
+		t.Errorf("expected LoadSigner to fail for an unknown KMS key")
+	}
+	if _, err := LoadSigner(context.Background(), "nokms://key", nil); err == nil || !strings.Contains(err.Error(), "sigstore-kms-nokms") {
+		t.Errorf("expected LoadSigner to ask for the KMS plugin, got %v", err)
+	}
+	roles := map[string]RoleOptions{"root": {Signer: rootSigner}, "targets": {Signer: targetsSigner}}
+
+	local, dir, err := CreateRepoWithOptions(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true, Roles: roles})
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	for _, name := range []string{"root.json", "targets.json"} {
+		if _, ok := keyFiles[name]; ok {
+			t.Errorf("expected no %s key file", name)
+		}
+	}
+
+	// Updating the targets requires the targets signer.
+	updated := map[string][]byte{
+		"rekor.pub": []byte(ctlogPublicKey),
+	}
+	if _, err := UpdateRepoWithOptions(context.Background(), dir, updated, CreateRepoOptions{AddMetadataTargets: true}); err == nil {
+		t.Errorf("expected UpdateRepoWithOptions to fail without the targets signer")
+	}
+	if _, err := UpdateRepoWithOptions(context.Background(), dir, updated, CreateRepoOptions{AddMetadataTargets: true, Roles: roles}); err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+
+	cfg, err := config.New(verifyBaseURL, meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(dir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	info, err := c.GetTargetInfo("rekor.pub")
+	if err != nil {
+		t.Fatalf("Failed to find target rekor.pub: %v", err)
+	}
+	_, content, err := c.DownloadTarget(info, "", "")
+	if err != nil {
+		t.Fatalf("Failed to download rekor.pub: %v", err)
+	}
+	if string(content) != ctlogPublicKey {
+		t.Errorf("rekor.pub was not replaced, got %s", content)
+	}
+
+	// Only ECDSA P-256 and Ed25519 keys can be used, and only for root and
+	// targets.
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p384Signer, err := signature.LoadECDSASignerVerifier(p384Key, crypto.SHA384)
+	if err != nil {
+		t.Fatalf("Failed to load signer: %v", err)
+	}
+	for _, invalid := range []map[string]RoleOptions{
+		{"root": {Signer: p384Signer}},
+		{"timestamp": {Signer: rootSigner}},
+		{"targets": {Signer: targetsSigner, Keys: 2}},
+	} {
+		if _, err := CreateRepoInMemory(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true, Roles: invalid}); err == nil {
+			t.Errorf("expected role options %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	compress := func(files map[string][]byte) []byte {
+		t.Helper()
+		local, err := CreateRepoInMemory(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true})
+		if err != nil {
+			t.Fatalf("Failed to CreateRepoInMemory: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := CompressFS(local.FS(), &buf, map[string]bool{"keys": true, "staged": true}); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		return buf.Bytes()
+	}
+	readRoot := func(targetDir string) []byte {
+		t.Helper()
+		root, err := os.ReadFile(filepath.Join(targetDir, "repository", "root.json"))
+		if err != nil {
+			t.Fatalf("Failed to read root.json: %v", err)
+		}
+		return root
+	}
+	listVersions := func(targetDir string) []string {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(targetDir, versionsDir))
+		if err != nil {
+			t.Fatalf("Failed to list versions: %v", err)
+		}
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	first := compress(map[string][]byte{"rekor.pub": []byte(rekorPublicKey)})
+	second := compress(map[string][]byte{"ctfe.pub": []byte(ctlogPublicKey)})
+	// Canceling stops the removal of replaced versions in the background.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A repository that was uncompressed in place is replaced as well, and
+	// kept as a replaced version.
+	targetDir := t.TempDir()
+	if err := Uncompress(bytes.NewReader(first), targetDir); err != nil {
+		t.Fatalf("Failed to uncompress: %v", err)
+	}
+	inPlaceRoot := readRoot(targetDir)
+	if err := Publish(ctx, second, targetDir, time.Hour); err != nil {
+		t.Fatalf("Failed to Publish: %v", err)
+	}
+	if bytes.Equal(readRoot(targetDir), inPlaceRoot) {
+		t.Errorf("repository was not replaced")
+	}
+	fi, err := os.Lstat(filepath.Join(targetDir, "repository"))
+	if err != nil {
+		t.Fatalf("Failed to stat repository: %v", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected repository to be a symlink")
+	}
+	if versions := listVersions(targetDir); len(versions) != 2 {
+		t.Errorf("expected the replaced version to be kept during the grace period, got %v", versions)
+	}
+	if legacyRoot, err := os.ReadFile(filepath.Join(targetDir, versionsDir, "0", "repository", "root.json")); err != nil || !bytes.Equal(legacyRoot, inPlaceRoot) {
+		t.Errorf("expected the in place repository to be kept as version 0: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "repository.new")); err == nil {
+		t.Errorf("repository.new was left behind")
+	}
+
+	// Replaced versions are removed once the grace period is over.
+	if err := Publish(ctx, first, targetDir, 0); err != nil {
+		t.Fatalf("Failed to Publish: %v", err)
+	}
+	if versions := listVersions(targetDir); len(versions) != 1 {
+		t.Errorf("expected only the current version to be left, got %v", versions)
+	}
+	targets, err := os.ReadDir(filepath.Join(targetDir, "repository", "targets"))
+	if err != nil {
+		t.Fatalf("Failed to list targets: %v", err)
+	}
+	if len(targets) == 0 || !strings.HasSuffix(targets[0].Name(), ".rekor.pub") {
+		t.Errorf("expected rekor.pub to be published, got %v", targets)
+	}
+
+	// Without another Publish, they are removed in the background.
+	if err := Publish(ctx, second, targetDir, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to Publish: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(listVersions(targetDir)) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the replaced version to be removed after the grace period, got %v", listVersions(targetDir))
+		}
+	}
+
+	// A broken repository doesn't replace the current one.
+	current := readRoot(targetDir)
+	if err := Publish(ctx, []byte("not a repository"), targetDir, 0); err == nil {
+		t.Errorf("expected Publish to fail")
+	}
+	if !bytes.Equal(readRoot(targetDir), current) {
+		t.Errorf("repository was replaced by a broken one")
+	}
+}
+
+func TestSigningCeremony(t *testing.T) {
+	files := map[string][]byte{
+		"rekor.pub": []byte(rekorPublicKey),
+	}
+	// Locally generated keys stand in for the offline ones.
+	offlineSigners := map[string][]ed25519.PrivateKey{}
+	offlineKeys := map[string][]*metadata.Key{}
+	for role, n := range map[string]int{"root": 2, "targets": 1} {
+		for i := 0; i < n; i++ {
+			pub, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+			key, err := metadata.KeyFromPublicKey(pub)
+			if err != nil {
+				t.Fatalf("Failed to convert key: %v", err)
+			}
+			offlineSigners[role] = append(offlineSigners[role], priv)
+			offlineKeys[role] = append(offlineKeys[role], key)
+		}
+	}
+	roles := map[string]RoleOptions{"root": {Threshold: 2}}
+
+	dir := filepath.Join(t.TempDir(), "repo")
+	payloads, err := ExportUnsigned(context.Background(), dir, files, offlineKeys, CreateRepoOptions{AddMetadataTargets: true, Roles: roles})
+	if err != nil {
+		t.Fatalf("Failed to ExportUnsigned: %v", err)
+	}
+	if len(payloads) != 2 {
+		t.Fatalf("expected payloads for root.json and targets.json, got %d", len(payloads))
+	}
+	// Only the online keys are kept with the repository.
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	if _, ok := keyFiles["root.json"]; ok {
+		t.Errorf("expected no root keys in the repository")
+	}
+	if _, ok := keyFiles["timestamp.json"]; !ok {
+		t.Errorf("expected timestamp keys in the repository")
+	}
+
+	sign := func(role string, signers []ed25519.PrivateKey) []metadata.Signature {
+		t.Helper()
+		sigs := []metadata.Signature{}
+		for _, signer := range signers {
+			key, err := metadata.KeyFromPublicKey(signer.Public())
+			if err != nil {
+				t.Fatalf("Failed to convert key: %v", err)
+			}
+			keyID, err := key.ID()
+			if err != nil {
+				t.Fatalf("Failed to get key ID: %v", err)
+			}
+			sigs = append(sigs, metadata.Signature{KeyID: keyID, Signature: ed25519.Sign(signer, payloads[role+".json"])})
+		}
+		return sigs
+	}
+
+	// Signatures that don't meet the thresholds are rejected, and nothing is
+	// committed.
+	for name, signatures := range map[string]map[string][]metadata.Signature{
+		"untrusted key": {"root.json": sign("root", offlineSigners["targets"])},
+		"threshold not met": {
+			"root.json":    sign("root", offlineSigners["root"][:1]),
+			"targets.json": sign("targets", offlineSigners["targets"]),
+		},
+	} {
+		if _, err := ImportSignatures(context.Background(), dir, signatures, roles); err == nil {
+			t.Errorf("%s: expected the signatures to be rejected", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "repository", "root.json")); err == nil {
+			t.Fatalf("%s: expected root.json not to be committed", name)
+		}
+	}
+
+	local, err := ImportSignatures(context.Background(), dir, map[string][]metadata.Signature{
+		"root.json":    sign("root", offlineSigners["root"]),
+		"targets.json": sign("targets", offlineSigners["targets"]),
+	}, roles)
+	if err != nil {
+		t.Fatalf("Failed to ImportSignatures: %v", err)
+	}
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+
+	cfg, err := config.New(verifyBaseURL, meta["root.json"])
+	if err != nil {
+		t.Fatalf("Failed to create client config: %v", err)
+	}
+	cfg.Fetcher = fsFetcher{os.DirFS(dir)}
+	cfg.DisableLocalCache = true
+	c, err := updater.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	info, err := c.GetTargetInfo("rekor.pub")
+	if err != nil {
+		t.Fatalf("Failed to find target rekor.pub: %v", err)
+	}
+	_, content, err := c.DownloadTarget(info, "", "")
+	if err != nil {
+		t.Fatalf("Failed to download rekor.pub: %v", err)
+	}
+	if string(content) != rekorPublicKey {
+		t.Errorf("unexpected contents of rekor.pub: %s", content)
+	}
+
+	// Only root and targets can have offline keys.
+	if _, err := ExportUnsigned(context.Background(), t.TempDir(), files, map[string][]*metadata.Key{"timestamp": offlineKeys["targets"]}, CreateRepoOptions{AddMetadataTargets: true}); err == nil {
+		t.Errorf("expected offline timestamp keys to be rejected")
+	}
+}
+
+func TestSigstoreClientCompatibility(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	options := CreateRepoOptions{AddMetadataTargets: true, AddTrustedRoot: true}
+	_, dir, err := CreateRepoWithOptions(context.Background(), files, options)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// testdata/legacy-repo.tar.gz holds a repository for the same files with
+	// a trusted root and the keys of all roles, created the way this package
+	// used to with the go-tuf v0.7.0 repo API.
+	legacy, err := os.ReadFile(filepath.Join("testdata", "legacy-repo.tar.gz"))
+	if err != nil {
+		t.Fatalf("Failed to read legacy repo: %v", err)
+	}
+	legacyDir := t.TempDir()
+	if err := Uncompress(bytes.NewReader(legacy), legacyDir); err != nil {
+		t.Fatalf("Failed to uncompress legacy repo: %v", err)
+	}
+
+	for name, dir := range map[string]string{"legacy": legacyDir, "v2": dir} {
+		t.Run(name, func(t *testing.T) {
+			initialRoot, err := os.ReadFile(filepath.Join(dir, "repository", "1.root.json"))
+			if err != nil {
+				t.Fatalf("Failed to read root: %v", err)
+			}
+			server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(dir, "repository"))))
+			defer server.Close()
+			c, err := sigstoretuf.New(&sigstoretuf.Options{Root: initialRoot, RepositoryBaseURL: server.URL, DisableLocalCache: true})
+			if err != nil {
+				t.Fatalf("Failed to create sigstore-go TUF client: %v", err)
+			}
+			trustedRootJSON, err := c.GetTarget("trusted_root.json")
+			if err != nil {
+				t.Fatalf("Failed to get trusted_root.json: %v", err)
+			}
+			if _, err := root.NewTrustedRootFromJSON(trustedRootJSON); err != nil {
+				t.Errorf("Failed to parse trusted_root.json: %v", err)
+			}
+			rekorPub, err := c.GetTarget("rekor.pub")
+			if err != nil {
+				t.Fatalf("Failed to get rekor.pub: %v", err)
+			}
+			if string(rekorPub) != rekorPublicKey {
+				t.Errorf("unexpected contents of rekor.pub: %s", rekorPub)
+			}
+
+			// Both kinds of repositories can be modified further, and the
+			// client follows along.
+			updated := map[string][]byte{
+				"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+				"rekor.pub":         []byte(ctlogPublicKey),
+			}
+			if _, err := UpdateRepoWithOptions(context.Background(), dir, updated, options); err != nil {
+				t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+			}
+			if _, err := RotateRoot(context.Background(), dir, nil); err != nil {
+				t.Fatalf("Failed to RotateRoot: %v", err)
+			}
+			if _, err := ResignOnlineRoles(context.Background(), dir, nil); err != nil {
+				t.Fatalf("Failed to ResignOnlineRoles: %v", err)
+			}
+			if err := c.Refresh(); err != nil {
+				t.Fatalf("Failed to refresh sigstore-go TUF client: %v", err)
+			}
+			if rekorPub, err = c.GetTarget("rekor.pub"); err != nil {
+				t.Fatalf("Failed to get rekor.pub: %v", err)
+			}
+			if string(rekorPub) != ctlogPublicKey {
+				t.Errorf("rekor.pub was not replaced, got %s", rekorPub)
+			}
+			if _, err := c.GetTarget("ctfe.pub"); err == nil {
+				t.Errorf("expected ctfe.pub to be removed")
+			}
+		})
+	}
+}
+
+func TestCreateRepoWithDelegations(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	options := CreateRepoOptions{
+		AddMetadataTargets: true,
+		Delegations: []Delegation{
+			{Name: "rekor", Paths: []string{"rekor*"}, RoleOptions: RoleOptions{Expires: 365 * 24 * time.Hour}},
+			{Name: "ctlog", Paths: []string{"ctfe*", "rekor*"}, RoleOptions: RoleOptions{Keys: 2, Threshold: 2}},
+		},
+	}
+	local, dir, err := CreateRepoWithOptions(context.Background(), files, options)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	meta, err := local.GetMeta()
+	if err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+	// Every target is signed by the first role that is delegated its path.
+	for role, want := range map[string][]string{
+		"targets.json": {"fulcio_v1.crt.pem"},
+		"rekor.json":   {"rekor.pub"},
+		"ctlog.json":   {"ctfe.pub"},
+	} {
+		md, err := (&metadata.Metadata[metadata.TargetsType]{}).FromBytes(meta[role])
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", role, err)
+		}
+		got := slices.Sorted(maps.Keys(md.Signed.Targets))
+		if !slices.Equal(got, want) {
+			t.Errorf("unexpected targets in %s: got %v, want %v", role, got, want)
+		}
+	}
+	for _, name := range []string{"1.rekor.json", "1.ctlog.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "repository", name)); err != nil {
+			t.Errorf("expected %s: %v", name, err)
+		}
+	}
+	keyFiles := map[string][]byte{}
+	entries, err := os.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read keys dir: %v", err)
+	}
+	for _, e := range entries {
+		if keyFiles[e.Name()], err = os.ReadFile(filepath.Join(dir, "keys", e.Name())); err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+	}
+	for _, name := range []string{"rekor.json", "ctlog.json"} {
+		if _, ok := keyFiles[name]; !ok {
+			t.Errorf("expected the keys of the delegated roles to be stored, %s is missing", name)
+		}
+	}
+
+	initialRoot, err := os.ReadFile(filepath.Join(dir, "repository", "1.root.json"))
+	if err != nil {
+		t.Fatalf("Failed to read root: %v", err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(dir, "repository"))))
+	defer server.Close()
+	c, err := sigstoretuf.New(&sigstoretuf.Options{Root: initialRoot, RepositoryBaseURL: server.URL, DisableLocalCache: true})
+	if err != nil {
+		t.Fatalf("Failed to create sigstore-go TUF client: %v", err)
+	}
+	for name, want := range files {
+		got, err := c.GetTarget(name)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("unexpected contents of %s: %s", name, got)
+		}
+	}
+
+	// The delegated targets can be replaced without the targets keys.
+	if err := os.Remove(filepath.Join(dir, "keys", "targets.json")); err != nil {
+		t.Fatalf("Failed to remove targets keys: %v", err)
+	}
+	updated := maps.Clone(files)
+	updated["rekor.pub"] = []byte(ctlogPublicKey)
+	local, err = UpdateRepoWithOptions(context.Background(), dir, updated, options)
+	if err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+	if meta, err = local.GetMeta(); err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+	snapshot, err := (&metadata.Metadata[metadata.SnapshotType]{}).FromBytes(meta["snapshot.json"])
+	if err != nil {
+		t.Fatalf("Failed to parse snapshot: %v", err)
+	}
+	for role, want := range map[string]int64{"targets.json": 1, "rekor.json": 2, "ctlog.json": 1} {
+		if got := snapshot.Signed.Meta[role].Version; got != want {
+			t.Errorf("unexpected version of %s in snapshot: got %d, want %d", role, got, want)
+		}
+	}
+
+	// Removing a target of the targets role still requires its keys, and
+	// delegations can't be changed once the repository is created.
+	withoutFulcio := maps.Clone(updated)
+	delete(withoutFulcio, "fulcio_v1.crt.pem")
+	changed := options
+	changed.Delegations = []Delegation{{Name: "rekor", Paths: []string{"rekor.pub"}}}
+	for name, tc := range map[string]struct {
+		files   map[string][]byte
+		options CreateRepoOptions
+	}{
+		"removed target":     {withoutFulcio, options},
+		"changed delegation": {updated, changed},
+	} {
+		if _, err := UpdateRepoWithOptions(context.Background(), dir, tc.files, tc.options); err == nil {
+			t.Errorf("%s: expected UpdateRepoWithOptions to fail", name)
+		}
+	}
+
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Failed to refresh sigstore-go TUF client: %v", err)
+	}
+	rekorPub, err := c.GetTarget("rekor.pub")
+	if err != nil {
+		t.Fatalf("Failed to get rekor.pub: %v", err)
+	}
+	if string(rekorPub) != ctlogPublicKey {
+		t.Errorf("rekor.pub was not replaced, got %s", rekorPub)
+	}
+
+	// Updates without delegations keep the expiration of the delegated roles.
+	rekor, err := (&metadata.Metadata[metadata.TargetsType]{}).FromBytes(meta["rekor.json"])
+	if err != nil {
+		t.Fatalf("Failed to parse rekor.json: %v", err)
+	}
+	if local, err = UpdateRepoWithOptions(context.Background(), dir, files, CreateRepoOptions{AddMetadataTargets: true}); err != nil {
+		t.Fatalf("Failed to UpdateRepoWithOptions: %v", err)
+	}
+	if meta, err = local.GetMeta(); err != nil {
+		t.Fatalf("Failed to GetMeta: %v", err)
+	}
+	updatedRekor, err := (&metadata.Metadata[metadata.TargetsType]{}).FromBytes(meta["rekor.json"])
+	if err != nil {
+		t.Fatalf("Failed to parse rekor.json: %v", err)
+	}
+	if updatedRekor.Signed.Version != 3 || !updatedRekor.Signed.Expires.Equal(rekor.Signed.Expires) {
+		t.Errorf("expected version 3 of rekor.json to expire at %s, got version %d expiring at %s", rekor.Signed.Expires, updatedRekor.Signed.Version, updatedRekor.Signed.Expires)
+	}
+
+	_, signerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := signature.LoadED25519SignerVerifier(signerKey)
+	if err != nil {
+		t.Fatalf("Failed to load signer: %v", err)
+	}
+	for name, delegations := range map[string][]Delegation{
+		"top-level role name": {{Name: "targets", Paths: []string{"*"}}},
+		"invalid name":        {{Name: "../rekor", Paths: []string{"*"}}},
+		"duplicate name":      {{Name: "rekor", Paths: []string{"*"}}, {Name: "rekor", Paths: []string{"*"}}},
+		"no paths":            {{Name: "rekor"}},
+		"invalid path":        {{Name: "rekor", Paths: []string{"["}}},
+		"signer":              {{Name: "rekor", Paths: []string{"*"}, RoleOptions: RoleOptions{Signer: signer}}},
+		"threshold":           {{Name: "rekor", Paths: []string{"*"}, RoleOptions: RoleOptions{Threshold: 2}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := CreateRepoInMemory(context.Background(), files, CreateRepoOptions{AddMetadataTargets: true, Delegations: delegations}); err == nil {
+				t.Errorf("expected invalid delegations to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyRepo(t *testing.T) {
+	options := CreateRepoOptions{
+		AddMetadataTargets: true,
+		AddTrustedRoot:     true,
+		AddSigningConfig:   true,
+		Delegations:        []Delegation{{Name: "rekor", Paths: []string{"rekor*"}}},
+	}
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	_, dir, err := CreateRepoWithOptions(context.Background(), files, options)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := RotateRoot(context.Background(), dir, nil); err != nil {
+		t.Fatalf("Failed to RotateRoot: %v", err)
+	}
+	if err := VerifyRepo(context.Background(), os.DirFS(dir)); err != nil {
+		t.Errorf("Failed to VerifyRepo: %v", err)
+	}
+
+	// A target whose content does not match its hashes.
+	matches, err := filepath.Glob(filepath.Join(dir, "repository", "targets", "*.rekor.pub"))
+	if err != nil || len(matches) == 0 {
+		t.Fatalf("Failed to find stored rekor.pub: %v", err)
+	}
+	for _, m := range matches {
+		if err := os.WriteFile(m, []byte(ctlogPublicKey), 0644); err != nil {
+			t.Fatalf("Failed to overwrite rekor.pub: %v", err)
+		}
+	}
+	// A trusted_root.json that can't be parsed.
+	m, err := CreateRepoWithMetadataInMemory(context.Background(), []TargetWithMetadata{{Name: "trusted_root.json", Bytes: []byte(`{"mediaType": "invalid"}`)}}, nil)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithMetadataInMemory: %v", err)
+	}
+	invalidTrustedRoot := m.FS()
+	for _, tc := range []struct {
+		name    string
+		fsys    fs.FS
+		wantErr string
+	}{
+		{"tampered target", os.DirFS(dir), "rekor.pub"},
+		{"invalid trusted root", invalidTrustedRoot, "trusted_root.json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := VerifyRepo(context.Background(), tc.fsys); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected VerifyRepo to fail for %s, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestInspectRepo(t *testing.T) {
+	files := map[string][]byte{
+		"fulcio_v1.crt.pem": []byte(fulcioRootCert),
+		"ctfe.pub":          []byte(ctlogPublicKey),
+		"rekor.pub":         []byte(rekorPublicKey),
+	}
+	options := CreateRepoOptions{
+		AddMetadataTargets: true,
+		AddTrustedRoot:     true,
+		Delegations:        []Delegation{{Name: "rekor", Paths: []string{"rekor*"}}},
+	}
+	_, dir, err := CreateRepoWithOptions(context.Background(), files, options)
+	if err != nil {
+		t.Fatalf("Failed to CreateRepoWithOptions: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := RotateRoot(context.Background(), dir, nil); err != nil {
+		t.Fatalf("Failed to RotateRoot: %v", err)
+	}
+	in, err := InspectRepo(os.DirFS(dir), time.Now())
+	if err != nil {
+		t.Fatalf("Failed to InspectRepo: %v", err)
+	}
+	if len(in.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", in.Errors)
+	}
+	var roles []string
+	for _, r := range in.Roles {
+		roles = append(roles, r.Name)
+		if r.Expired || r.Signatures < r.Threshold || len(r.KeyIDs) == 0 {
+			t.Errorf("unexpected role %+v", r)
+		}
+		if r.Name == "root" && r.Version != 2 {
+			t.Errorf("expected root version 2, got %d", r.Version)
+		}
+	}
+	if want := []string{"root", "timestamp", "snapshot", "targets", "rekor"}; !slices.Equal(roles, want) {
+		t.Errorf("expected roles %v, got %v", want, roles)
+	}
+	for _, target := range in.Targets {
+		wantRole := "targets"
+		if target.Name == "rekor.pub" {
+			wantRole = "rekor"
+			if target.Sigstore == nil || target.Sigstore.Usage != RekorTarget {
+				t.Errorf("unexpected custom metadata for rekor.pub: %+v", target.Sigstore)
+			}
+		}
+		if target.Role != wantRole {
+			t.Errorf("expected %s to be signed by %s, got %s", target.Name, wantRole, target.Role)
+		}
+	}
+	if len(in.Targets) != 4 {
+		t.Errorf("expected 4 targets, got %d", len(in.Targets))
+	}
+	if in.TrustedRoot == nil {
+		t.Fatal("expected a trusted root summary")
+	}
+	if len(in.TrustedRoot.CertificateAuthorities) != 1 || len(in.TrustedRoot.TransparencyLogs) != 1 || len(in.TrustedRoot.CTLogs) != 1 {
+		t.Errorf("unexpected trusted root summary %+v", in.TrustedRoot)
+	}
+
+	// A target whose content does not match its hashes, and an expired
+	// timestamp.
+	matches, err := filepath.Glob(filepath.Join(dir, "repository", "targets", "*.rekor.pub"))
+	if err != nil || len(matches) == 0 {
+		t.Fatalf("Failed to find stored rekor.pub: %v", err)
+	}
+	for _, m := range matches {
+		if err := os.WriteFile(m, []byte(ctlogPublicKey), 0644); err != nil {
+			t.Fatalf("Failed to overwrite rekor.pub: %v", err)
+		}
+	}
+	in, err = InspectRepo(os.DirFS(dir), time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatalf("Failed to InspectRepo: %v", err)
+	}
+	if len(in.Errors) == 0 || !strings.Contains(strings.Join(in.Errors, "\n"), "target rekor.pub") {
+		t.Errorf("expected an error for rekor.pub, got %v", in.Errors)
+	}
+	if in.Roles[1].Name != "timestamp" || !in.Roles[1].Expired {
+		t.Errorf("expected timestamp to be expired, got %+v", in.Roles[1])
+	}
+
+	// A timestamp whose signed content was changed.
+	content, err := os.ReadFile(filepath.Join(dir, "repository", "timestamp.json"))
+	if err != nil {
+		t.Fatalf("Failed to read timestamp.json: %v", err)
+	}
+	content = bytes.Replace(content, []byte(`"version": `), []byte(`"version": 1`), 1)
+	if err := os.WriteFile(filepath.Join(dir, "repository", "timestamp.json"), content, 0644); err != nil {
+		t.Fatalf("Failed to write timestamp.json: %v", err)
+	}
+	in, err = InspectRepo(os.DirFS(dir), time.Now())
+	if err != nil {
+		t.Fatalf("Failed to InspectRepo: %v", err)
+	}
+	if !strings.Contains(strings.Join(in.Errors, "\n"), "timestamp.json") {
+		t.Errorf("expected an error for timestamp.json, got %v", in.Errors)
+	}
+}
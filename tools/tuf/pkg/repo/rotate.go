@@ -0,0 +1,156 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"knative.dev/pkg/logging"
+)
+
+// LoadRepo recreates a TUF repository working directory from a repository
+// compressed with CompressFS and the key files that were stored alongside it
+// (e.g. "root.json", "targets.json", ...), so that the repository can be
+// modified further. It returns the directory that was created, which is
+// removed again if loading fails.
+func LoadRepo(ctx context.Context, repository []byte, keyFiles map[string][]byte) (_ string, err error) {
+	dir, err := os.MkdirTemp("", "tuf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create tmp TUF dir: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	logging.FromContext(ctx).Infof("Loading existing repo into %q", dir)
+
+	if err := Uncompress(bytes.NewReader(repository), dir); err != nil {
+		return "", fmt.Errorf("failed to uncompress repository: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0700); err != nil {
+		return "", fmt.Errorf("failed to create keys dir: %w", err)
+	}
+	for name, content := range keyFiles {
+		if name != filepath.Base(name) || !strings.HasSuffix(name, ".json") {
+			return "", fmt.Errorf("invalid key file name %q", name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "keys", name), content, 0600); err != nil {
+			return "", fmt.Errorf("failed to write key file %s: %w", name, err)
+		}
+	}
+	return dir, nil
+}
+
+// RotateRoot replaces the root keys of the TUF repository in dir (as returned
+// by CreateRepoWithOptions or LoadRepo) with newly generated ones. Unless
+// configured otherwise by the "root" entry in roles, the same number of keys
+// and the same threshold as in the current root are used.
+// The next version of root.json is signed with both the old and the new root
+// keys, so clients that trust the current root can update to it. Once
+// committed, the retired root keys are removed from the keys directory.
+// Rotating from or to a root RoleOptions.Signer is not supported.
+func RotateRoot(ctx context.Context, dir string, roles map[string]RoleOptions) (LocalStore, error) {
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+	if roles["root"].Signer != nil {
+		return nil, errors.New("rotating root keys held by a signer is not supported")
+	}
+
+	fsys := newDirFS(dir)
+	r, err := openTUFRepo(fsys, nil)
+	if err != nil {
+		return nil, err
+	}
+	oldKeyIDs := slices.Clone(r.root.Signed.Roles["root"].KeyIDs)
+	if len(oldKeyIDs) == 0 {
+		return nil, errors.New("repository has no root keys to rotate")
+	}
+	if len(r.keys["root"]) == 0 {
+		return nil, errors.New("no private root keys found, unable to sign new root")
+	}
+	// The new root has to be trusted by clients that only know the current
+	// one.
+	content, err := r.root.ToBytes(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal root: %w", err)
+	}
+	oldRoot, err := (&metadata.Metadata[metadata.RootType]{}).FromBytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy root: %w", err)
+	}
+
+	o := roles["root"]
+	numKeys := len(oldKeyIDs)
+	if o.Keys > 0 {
+		numKeys = o.keys()
+	}
+	threshold := r.root.Signed.Roles["root"].Threshold
+	if o.Threshold > 0 {
+		threshold = o.threshold()
+	}
+	if threshold > numKeys {
+		return nil, fmt.Errorf("root threshold %d is larger than the number of keys %d", threshold, numKeys)
+	}
+
+	// Add the new keys before revoking the old ones, so that the root role
+	// never ends up with fewer keys than its threshold.
+	newKeys := make([]*signingKey, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key, sk, err := generateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate root key: %w", err)
+		}
+		if err := r.root.Signed.AddKey(key, "root"); err != nil {
+			return nil, fmt.Errorf("failed to add root key: %w", err)
+		}
+		newKeys = append(newKeys, sk)
+	}
+	for _, id := range oldKeyIDs {
+		if err := r.root.Signed.RevokeKey(id, "root"); err != nil {
+			return nil, fmt.Errorf("failed to revoke root key: %w", err)
+		}
+	}
+	r.root.Signed.Roles["root"].Threshold = threshold
+	r.root.Signed.Version++
+	r.root.Signed.Expires = o.expires(time.Now())
+	r.root.ClearSignatures()
+
+	// The new version is signed with both the old and the new keys, but
+	// only the new ones are kept.
+	r.keys["root"] = append(r.keys["root"], newKeys...)
+	if err := r.signRoot(oldRoot); err != nil {
+		return nil, err
+	}
+	r.keys["root"] = newKeys
+	if err := r.saveKeys("root"); err != nil {
+		return nil, err
+	}
+	if err := r.write(); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Infof("Rotated root from version %d to %d", oldRoot.Signed.Version, r.root.Signed.Version)
+	return fsStore{fsys}, nil
+}
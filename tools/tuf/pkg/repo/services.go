@@ -0,0 +1,148 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	prototrustroot "github.com/sigstore/protobuf-specs/gen/pb-go/trustroot/v1"
+	"github.com/sigstore/sigstore-go/pkg/root"
+)
+
+// ServiceNames are the services that can be configured with Service.
+var ServiceNames = []string{"fulcio", "oidc", "rekor", "ctlog", "tsa"}
+
+// logServices are the services that are transparency logs with an origin.
+var logServices = []string{"rekor", "ctlog"}
+
+// selectorServices are the services with a selector in signing_config.
+var selectorServices = []string{"rekor", "tsa"}
+
+// Service configures how a service is described in trusted_root.json and
+// signing_config.v0.2.json. Empty fields get the defaults of the service,
+// which match the services deployed by scaffolding.
+type Service struct {
+	// URL is the base URL of the service.
+	URL string
+	// Origin is the origin of a Rekor or CTFE log, which is used to compute
+	// the log ID. Defaults to the host of URL.
+	Origin string
+	// APIVersion is the major API version of the service.
+	APIVersion uint32
+	// Operator is the name of the operator of the service.
+	Operator string
+	// Selector is the selector for the Rekor and TSA services in
+	// signing_config, one of ANY, ALL or EXACT.
+	Selector string
+	// Count is the number of services to use with the EXACT selector.
+	Count uint32
+}
+
+var defaultServices = map[string]Service{
+	"fulcio": {URL: "http://fulcio.fulcio-system.svc", APIVersion: 1, Operator: "test"},
+	"oidc":   {URL: "https://kubernetes.default.svc.cluster.local", APIVersion: 1, Operator: "test"},
+	"rekor":  {URL: "http://rekor.rekor-system.svc", APIVersion: 2, Operator: "test", Selector: "ANY"},
+	// The CT log is only part of trusted_root.json, which has no base URL
+	// for it unless one is configured.
+	"ctlog": {Origin: "ctlog.ctlog-system.svc"},
+	"tsa":   {URL: "http://tsa.tsa-system.svc/api/v1/timestamp", APIVersion: 1, Operator: "test", Selector: "ANY"},
+}
+
+// validateServices checks that the given services can be used.
+func validateServices(services map[string]Service) error {
+	for name, s := range services {
+		if !slices.Contains(ServiceNames, name) {
+			return fmt.Errorf("unknown service %q", name)
+		}
+		if s.Origin != "" && !slices.Contains(logServices, name) {
+			return fmt.Errorf("service %s: origin is only supported for %s", name, strings.Join(logServices, " and "))
+		}
+		if name == "rekor" && s.APIVersion > 2 {
+			return fmt.Errorf("service %s: unsupported API version %d", name, s.APIVersion)
+		}
+		if s.Selector == "" && s.Count == 0 {
+			continue
+		}
+		if !slices.Contains(selectorServices, name) {
+			return fmt.Errorf("service %s: selector is only supported for %s", name, strings.Join(selectorServices, " and "))
+		}
+		if _, err := getService(services, name).serviceConfiguration(); err != nil {
+			return fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// getService returns the named service from services, with the defaults
+// filled in.
+func getService(services map[string]Service, name string) Service {
+	s, d := services[name], defaultServices[name]
+	if s.URL == "" {
+		s.URL = d.URL
+		if s.Origin == "" {
+			s.Origin = d.Origin
+		}
+	}
+	if s.APIVersion == 0 {
+		s.APIVersion = d.APIVersion
+	}
+	if s.Operator == "" {
+		s.Operator = d.Operator
+	}
+	if s.Selector == "" {
+		s.Selector = d.Selector
+	}
+	return s
+}
+
+// origin returns the log origin of the service.
+func (s Service) origin() string {
+	if s.Origin != "" {
+		return s.Origin
+	}
+	origin := s.URL
+	if _, host, ok := strings.Cut(origin, "://"); ok {
+		origin = host
+	}
+	return strings.TrimSuffix(origin, "/")
+}
+
+// signingConfigService returns the service as used in signing_config.
+func (s Service) signingConfigService() root.Service {
+	return root.Service{
+		URL:             s.URL,
+		MajorAPIVersion: s.APIVersion,
+		Operator:        s.Operator,
+	}
+}
+
+// serviceConfiguration returns the selector of the service as used in
+// signing_config.
+func (s Service) serviceConfiguration() (root.ServiceConfiguration, error) {
+	selector, ok := prototrustroot.ServiceSelector_value[s.Selector]
+	if !ok || selector == int32(prototrustroot.ServiceSelector_SERVICE_SELECTOR_UNDEFINED) {
+		return root.ServiceConfiguration{}, fmt.Errorf("unknown selector %q", s.Selector)
+	}
+	switch {
+	case prototrustroot.ServiceSelector(selector) == prototrustroot.ServiceSelector_EXACT && s.Count == 0:
+		return root.ServiceConfiguration{}, errors.New("selector EXACT requires a count")
+	case prototrustroot.ServiceSelector(selector) != prototrustroot.ServiceSelector_EXACT && s.Count != 0:
+		return root.ServiceConfiguration{}, errors.New("count is only supported with selector EXACT")
+	}
+	return root.ServiceConfiguration{Selector: prototrustroot.ServiceSelector(selector), Count: s.Count}, nil
+}
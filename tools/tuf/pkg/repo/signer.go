@@ -0,0 +1,82 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/kms"
+	"github.com/sigstore/sigstore/pkg/signature/kms/cliplugin"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// SignerRoles are the roles that can sign with a RoleOptions.Signer.
+var SignerRoles = []string{"root", "targets"}
+
+// LoadSigner loads the signer referenced by ref, which is either a KMS URI
+// or the path of a private key in PEM format. The password of an encrypted
+// private key is read with pf.
+//
+// No KMS providers are built into this package: a KMS URI is handled by a
+// provider the program registered with kms.AddProvider (e.g. by importing
+// github.com/sigstore/sigstore/pkg/signature/kms/aws), or else by the sigstore
+// KMS plugin for its scheme, such as sigstore-kms-pkcs11 on $PATH for
+// "pkcs11://...".
+func LoadSigner(ctx context.Context, ref string, pf cryptoutils.PassFunc) (signature.SignerVerifier, error) {
+	if scheme, _, ok := strings.Cut(ref, "://"); ok {
+		sv, err := kms.Get(ctx, ref, crypto.SHA256)
+		var notFound *kms.ProviderNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to load KMS signer %s, %s%s has to be installed: %w", ref, cliplugin.PluginBinaryPrefix, scheme, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load KMS signer %s: %w", ref, err)
+		}
+		return sv, nil
+	}
+	sv, err := signature.LoadSignerVerifierFromPEMFile(ref, crypto.SHA256, pf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key %s: %w", ref, err)
+	}
+	return sv, nil
+}
+
+// signerKey returns the TUF key of sv, which has to hold an ECDSA P-256 or
+// Ed25519 key, as TUF has no key types matching the signatures of other keys.
+func signerKey(sv signature.SignerVerifier) (*metadata.Key, error) {
+	pub, err := sv.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s, only P-256 is supported", k.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, only ECDSA P-256 and Ed25519 keys are supported", pub)
+	}
+	return metadata.KeyFromPublicKey(pub)
+}
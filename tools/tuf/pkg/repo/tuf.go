@@ -0,0 +1,584 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	"github.com/secure-systems-lab/go-securesystemslib/cjson"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// hashAlgorithm is the algorithm of the hashes of targets and metadata files,
+// the same one go-tuf used by default.
+const hashAlgorithm = "sha512"
+
+// LocalStore gives access to the metadata of a TUF repository created or
+// modified by this package. Changes to the repository are made with
+// UpdateTargets, UpdateRepoWithOptions and the other functions of this
+// package.
+type LocalStore interface {
+	// GetMeta returns the metadata files of the repository by name, e.g.
+	// "root.json" or "1.root.json".
+	GetMeta() (map[string]json.RawMessage, error)
+}
+
+// fsStore is the LocalStore of the repository in fsys.
+type fsStore struct {
+	fsys fs.FS
+}
+
+func (s fsStore) GetMeta() (map[string]json.RawMessage, error) {
+	entries, err := fs.ReadDir(s.fsys, "repository")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata: %w", err)
+	}
+	meta := map[string]json.RawMessage{}
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".json" {
+			continue
+		}
+		content, err := fs.ReadFile(s.fsys, path.Join("repository", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", e.Name(), err)
+		}
+		meta[e.Name()] = content
+	}
+	return meta, nil
+}
+
+// repoFS holds the files of a TUF repository by slash separated path: the
+// metadata and the targets in "repository", the private keys of the roles in
+// "keys" and metadata waiting for offline signatures in "staged". This is the
+// layout of the directories of the legacy go-tuf repo API, so repositories
+// created by either can be modified by the other.
+type repoFS interface {
+	fs.FS
+	writeFile(name string, content []byte, perm fs.FileMode) error
+	// removeAll removes name and everything it contains.
+	removeAll(name string) error
+}
+
+// dirFS is a repoFS in a directory.
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func newDirFS(dir string) dirFS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+func (d dirFS) writeFile(name string, content []byte, perm fs.FileMode) error {
+	p := filepath.Join(d.dir, filepath.FromSlash(name))
+	// Directories are only readable by others if their files are.
+	dirPerm := fs.FileMode(0755)
+	if perm&0077 == 0 {
+		dirPerm = 0700
+	}
+	if err := os.MkdirAll(filepath.Dir(p), dirPerm); err != nil {
+		return err
+	}
+	return os.WriteFile(p, content, perm)
+}
+
+func (d dirFS) removeAll(name string) error {
+	return os.RemoveAll(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+// mapFS is a repoFS in memory.
+type mapFS struct {
+	fstest.MapFS
+}
+
+func (m mapFS) writeFile(name string, content []byte, perm fs.FileMode) error {
+	m.MapFS[name] = &fstest.MapFile{Data: content, Mode: perm}
+	return nil
+}
+
+func (m mapFS) removeAll(name string) error {
+	for p := range m.MapFS {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(m.MapFS, p)
+		}
+	}
+	return nil
+}
+
+// repoFile is a file waiting to be written to a repoFS.
+type repoFile struct {
+	name    string
+	content []byte
+	perm    fs.FileMode
+}
+
+// tufRepo is a TUF repository that is created or modified with the go-tuf v2
+// metadata API. Changes are signed by the sign* methods and only written to
+// the repoFS by write, so nothing is written if signing fails.
+type tufRepo struct {
+	fsys      repoFS
+	root      *metadata.Metadata[metadata.RootType]
+	targets   *metadata.Metadata[metadata.TargetsType]
+	snapshot  *metadata.Metadata[metadata.SnapshotType]
+	timestamp *metadata.Metadata[metadata.TimestampType]
+	// delegated holds the metadata of the delegated targets roles, by name.
+	delegated map[string]*metadata.Metadata[metadata.TargetsType]
+
+	// keys holds the keys the repository can sign with, by role.
+	keys map[string][]*signingKey
+	// files holds the contents of the targets that were added, by name.
+	files map[string][]byte
+	// signedTargets describes the targets metadata that was signed, by file
+	// name, for snapshot.json.
+	signedTargets map[string]*metadata.MetaFiles
+	// pending holds the files to write, in order.
+	pending []repoFile
+}
+
+// newTUFRepo returns a new repository in fsys. The top-level roles get the
+// keys in publicKeys, whose private keys are held offline, the key of their
+// RoleOptions.Signer, or generated keys. Nothing is signed yet.
+func newTUFRepo(fsys repoFS, roles map[string]RoleOptions, publicKeys map[string][]*metadata.Key, now time.Time) (*tufRepo, error) {
+	r := &tufRepo{
+		fsys:          fsys,
+		root:          metadata.Root(roles["root"].expires(now)),
+		targets:       metadata.Targets(roles["targets"].expires(now)),
+		delegated:     map[string]*metadata.Metadata[metadata.TargetsType]{},
+		keys:          map[string][]*signingKey{},
+		files:         map[string][]byte{},
+		signedTargets: map[string]*metadata.MetaFiles{},
+	}
+	for _, role := range TopLevelRoles {
+		o := roles[role]
+		pks, offline := publicKeys[role]
+		switch {
+		case offline:
+		case o.Signer != nil:
+			key, err := signerKey(o.Signer)
+			if err != nil {
+				return nil, fmt.Errorf("role %s: %w", role, err)
+			}
+			id, err := key.ID()
+			if err != nil {
+				return nil, fmt.Errorf("role %s: %w", role, err)
+			}
+			pks = []*metadata.Key{key}
+			r.keys[role] = []*signingKey{{id: id, signer: o.Signer}}
+		default:
+			for i := 0; i < o.keys(); i++ {
+				key, sk, err := generateKey()
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate %s key: %w", role, err)
+				}
+				pks = append(pks, key)
+				r.keys[role] = append(r.keys[role], sk)
+			}
+		}
+		for _, pk := range pks {
+			if err := r.root.Signed.AddKey(pk, role); err != nil {
+				return nil, fmt.Errorf("failed to add %s key: %w", role, err)
+			}
+		}
+		r.root.Signed.Roles[role].Threshold = o.threshold()
+	}
+	return r, nil
+}
+
+// openTUFRepo opens the existing repository in fsys, with the keys in its
+// keys directory and the ones of the RoleOptions.Signer in roles.
+func openTUFRepo(fsys repoFS, roles map[string]RoleOptions) (*tufRepo, error) {
+	r := &tufRepo{
+		fsys:          fsys,
+		delegated:     map[string]*metadata.Metadata[metadata.TargetsType]{},
+		keys:          map[string][]*signingKey{},
+		files:         map[string][]byte{},
+		signedTargets: map[string]*metadata.MetaFiles{},
+	}
+	var err error
+	if r.root, err = readMetadata[metadata.RootType](fsys, "repository/root.json"); err != nil {
+		return nil, err
+	}
+	if r.targets, err = readMetadata[metadata.TargetsType](fsys, "repository/targets.json"); err != nil {
+		return nil, err
+	}
+	if r.snapshot, err = readMetadata[metadata.SnapshotType](fsys, "repository/snapshot.json"); err != nil {
+		return nil, err
+	}
+	if r.timestamp, err = readMetadata[metadata.TimestampType](fsys, "repository/timestamp.json"); err != nil {
+		return nil, err
+	}
+	if err := r.readDelegations(); err != nil {
+		return nil, err
+	}
+	if err := r.loadKeys(roles); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readMetadata reads the metadata file name from fsys.
+func readMetadata[T metadata.Roles](fsys fs.FS, name string) (*metadata.Metadata[T], error) {
+	md, _, err := readMetadataFile[T](fsys, name)
+	return md, err
+}
+
+// readMetadataFile reads the metadata file name from fsys, and returns its
+// content as well.
+func readMetadataFile[T metadata.Roles](fsys fs.FS, name string) (*metadata.Metadata[T], []byte, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	md, err := (&metadata.Metadata[T]{}).FromBytes(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return md, content, nil
+}
+
+// loadKeys loads the keys of the top-level and the delegated roles from the
+// keys directory, and the ones of the top-level roles from the
+// RoleOptions.Signer in roles. Keys that are not listed for their role, e.g.
+// retired ones, are skipped.
+func (r *tufRepo) loadKeys(roles map[string]RoleOptions) error {
+	for _, role := range append(slices.Clone(TopLevelRoles), r.delegatedRoles()...) {
+		if sv := roles[role].Signer; sv != nil {
+			pub, err := sv.PublicKey()
+			if err != nil {
+				return fmt.Errorf("failed to get %s signer public key: %w", role, err)
+			}
+			id := r.keyID(role, pub)
+			if id == "" {
+				return fmt.Errorf("the %s signer does not hold a %s key of the repository", role, role)
+			}
+			r.keys[role] = append(r.keys[role], &signingKey{id: id, signer: sv})
+		}
+
+		name := path.Join("keys", role+".json")
+		content, err := fs.ReadFile(r.fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		privKeys, err := parseKeyFile(content)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		for _, privKey := range privKeys {
+			signer, err := privKey.loadSigner()
+			if err != nil {
+				return fmt.Errorf("failed to load key in %s: %w", name, err)
+			}
+			pub, err := signer.PublicKey()
+			if err != nil {
+				return fmt.Errorf("failed to get public key in %s: %w", name, err)
+			}
+			if id := r.keyID(role, pub); id != "" {
+				r.keys[role] = append(r.keys[role], &signingKey{id: id, signer: signer, private: privKey})
+			}
+		}
+	}
+	return nil
+}
+
+// keyID returns the ID of the key of role that is pub, or "" if there is
+// none. Keys are compared by value, as the IDs of keys added by go-tuf also
+// cover their "keyid_hash_algorithms".
+func (r *tufRepo) keyID(role string, pub crypto.PublicKey) string {
+	var keys map[string]*metadata.Key
+	var ids []string
+	if rr, ok := r.root.Signed.Roles[role]; ok {
+		keys, ids = r.root.Signed.Keys, rr.KeyIDs
+	} else if d, ok := r.delegatedRole(role); ok {
+		keys, ids = r.targets.Signed.Delegations.Keys, d.KeyIDs
+	}
+	for _, id := range ids {
+		key, ok := keys[id]
+		if !ok {
+			continue
+		}
+		if k, err := key.ToPublicKey(); err == nil && cryptoutils.EqualKeys(k, pub) == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// addTarget adds the target name with content and custom metadata to the
+// metadata of the role that signs it, replacing any target with the same
+// name.
+func (r *tufRepo) addTarget(name string, content, custom []byte) error {
+	_, md, err := r.targetsRole(name)
+	if err != nil {
+		return err
+	}
+	target, err := metadata.TargetFile().FromBytes(name, content, hashAlgorithm)
+	if err != nil {
+		return err
+	}
+	if len(custom) > 0 {
+		c := json.RawMessage(custom)
+		target.Custom = &c
+	}
+	md.Signed.Targets[name] = target
+	r.files[name] = content
+	return nil
+}
+
+// saveKeys queues the private keys of role for writing to the keys
+// directory. Nothing is written for roles without private keys.
+func (r *tufRepo) saveKeys(role string) error {
+	if !slices.ContainsFunc(r.keys[role], func(k *signingKey) bool { return k.private != nil }) {
+		return nil
+	}
+	content, err := marshalKeyFile(r.keys[role])
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s keys: %w", role, err)
+	}
+	r.pending = append(r.pending, repoFile{name: path.Join("keys", role+".json"), content: content, perm: 0600})
+	return nil
+}
+
+// signRoot signs root.json and queues it for writing. The signatures have to
+// meet the root threshold of root.json itself, and of each of trusted, the
+// root.json versions the new one replaces.
+func (r *tufRepo) signRoot(trusted ...*metadata.Metadata[metadata.RootType]) error {
+	if err := signMetadata(r.root, r.keys["root"]); err != nil {
+		return fmt.Errorf("failed to sign root: %w", err)
+	}
+	for _, root := range append(trusted, r.root) {
+		if err := root.VerifyDelegate("root", r.root); err != nil {
+			return fmt.Errorf("failed to sign root: %w", err)
+		}
+	}
+	content, err := r.root.ToBytes(true)
+	if err != nil {
+		return fmt.Errorf("failed to marshal root: %w", err)
+	}
+	r.queueMetadata("root", r.root.Signed.Version, content)
+	return nil
+}
+
+// delegator is the metadata of a role that delegates to other roles, i.e.
+// root or targets metadata.
+type delegator interface {
+	VerifyDelegate(delegatedRole string, delegatedMetadata any) error
+}
+
+// signTargets signs targets.json and queues it for writing, along with the
+// targets that were added to it.
+func (r *tufRepo) signTargets() error {
+	return r.signTargetsMetadata("targets", r.targets, r.root)
+}
+
+// signTargetsMetadata signs md, the metadata of the targets role or of a
+// delegated role, and queues it for writing, along with the targets that were
+// added to it. The signatures have to meet the threshold of role in the
+// metadata of the delegator.
+func (r *tufRepo) signTargetsMetadata(role string, md *metadata.Metadata[metadata.TargetsType], d delegator) error {
+	if err := signMetadata(md, r.keys[role]); err != nil {
+		return fmt.Errorf("failed to sign %s: %w", role, err)
+	}
+	if err := d.VerifyDelegate(role, md); err != nil {
+		return fmt.Errorf("failed to sign %s: %w", role, err)
+	}
+	content, err := md.ToBytes(true)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", role, err)
+	}
+	// The repository uses consistent snapshots, so every target is stored
+	// under each of its hashes.
+	for _, name := range slices.Sorted(maps.Keys(r.files)) {
+		target, ok := md.Signed.Targets[name]
+		if !ok {
+			continue
+		}
+		for _, p := range hashedPaths(name, target.Hashes) {
+			r.pending = append(r.pending, repoFile{name: path.Join("repository", "targets", p), content: r.files[name], perm: 0644})
+		}
+	}
+	r.queueMetadata(role, md.Signed.Version, content)
+	r.signedTargets[role+".json"] = metaFile(md.Signed.Version, content)
+	return nil
+}
+
+// signOnlineRoles signs new versions of snapshot.json and timestamp.json,
+// expiring as configured in roles, and queues them for writing. The snapshot
+// covers the targets metadata signed by signTargets and signDelegation, and
+// the earlier versions of the rest.
+func (r *tufRepo) signOnlineRoles(roles map[string]RoleOptions, now time.Time) error {
+	if r.snapshot == nil {
+		r.snapshot = metadata.Snapshot(roles["snapshot"].expires(now))
+	} else {
+		r.snapshot.Signed.Version++
+		r.snapshot.Signed.Expires = roles["snapshot"].expires(now)
+		r.snapshot.ClearSignatures()
+	}
+	maps.Copy(r.snapshot.Signed.Meta, r.signedTargets)
+	if err := signMetadata(r.snapshot, r.keys["snapshot"]); err != nil {
+		return fmt.Errorf("failed to sign snapshot: %w", err)
+	}
+	if err := r.root.VerifyDelegate("snapshot", r.snapshot); err != nil {
+		return fmt.Errorf("failed to sign snapshot: %w", err)
+	}
+	snapshotJSON, err := r.snapshot.ToBytes(true)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	r.queueMetadata("snapshot", r.snapshot.Signed.Version, snapshotJSON)
+
+	if r.timestamp == nil {
+		r.timestamp = metadata.Timestamp(roles["timestamp"].expires(now))
+	} else {
+		r.timestamp.Signed.Version++
+		r.timestamp.Signed.Expires = roles["timestamp"].expires(now)
+		r.timestamp.ClearSignatures()
+	}
+	r.timestamp.Signed.Meta["snapshot.json"] = metaFile(r.snapshot.Signed.Version, snapshotJSON)
+	if err := signMetadata(r.timestamp, r.keys["timestamp"]); err != nil {
+		return fmt.Errorf("failed to sign timestamp: %w", err)
+	}
+	if err := r.root.VerifyDelegate("timestamp", r.timestamp); err != nil {
+		return fmt.Errorf("failed to sign timestamp: %w", err)
+	}
+	timestampJSON, err := r.timestamp.ToBytes(true)
+	if err != nil {
+		return fmt.Errorf("failed to marshal timestamp: %w", err)
+	}
+	r.queueMetadata("timestamp", r.timestamp.Signed.Version, timestampJSON)
+	return nil
+}
+
+// queueMetadata queues the metadata of role for writing. Clients of a
+// repository with consistent snapshots fetch every version but the one of
+// timestamp.json by version number.
+func (r *tufRepo) queueMetadata(role string, version int64, content []byte) {
+	if role != "timestamp" {
+		r.pending = append(r.pending, repoFile{name: fmt.Sprintf("repository/%d.%s.json", version, role), content: content, perm: 0644})
+	}
+	r.pending = append(r.pending, repoFile{name: fmt.Sprintf("repository/%s.json", role), content: content, perm: 0644})
+}
+
+// write writes the queued files to the repoFS. If targets metadata was
+// signed, the stored targets that are no longer listed are removed
+// afterwards.
+func (r *tufRepo) write() error {
+	for _, f := range r.pending {
+		if err := r.fsys.writeFile(f.name, f.content, f.perm); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+	r.pending = nil
+	if len(r.signedTargets) == 0 {
+		return nil
+	}
+
+	remove := []string{}
+	err := fs.WalkDir(r.fsys, "repository/targets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// Strip the hash prefix to get the name of the target.
+		dir, file := path.Split(strings.TrimPrefix(p, "repository/targets/"))
+		_, name, ok := strings.Cut(file, ".")
+		if !ok {
+			return nil
+		}
+		if !r.hasTarget(dir + name) {
+			remove = append(remove, p)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to list targets: %w", err)
+	}
+	for _, p := range remove {
+		if err := r.fsys.removeAll(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// hasTarget returns true if the targets role or one of the delegated roles
+// lists the target name.
+func (r *tufRepo) hasTarget(name string) bool {
+	if _, ok := r.targets.Signed.Targets[name]; ok {
+		return true
+	}
+	for _, md := range r.delegated {
+		if _, ok := md.Signed.Targets[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// signMetadata adds signatures by keys to md, replacing earlier signatures
+// by the same keys.
+func signMetadata[T metadata.Roles](md *metadata.Metadata[T], keys []*signingKey) error {
+	payload, err := cjson.EncodeCanonical(md.Signed)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		sig, err := k.signer.SignMessage(bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("failed to sign with key %s: %w", k.id, err)
+		}
+		md.Signatures = slices.DeleteFunc(md.Signatures, func(s metadata.Signature) bool { return s.KeyID == k.id })
+		md.Signatures = append(md.Signatures, metadata.Signature{KeyID: k.id, Signature: sig})
+	}
+	return nil
+}
+
+// metaFile describes a metadata file in snapshot.json or timestamp.json.
+func metaFile(version int64, content []byte) *metadata.MetaFiles {
+	sum := sha512.Sum512(content)
+	return &metadata.MetaFiles{
+		Length:  int64(len(content)),
+		Hashes:  metadata.Hashes{hashAlgorithm: sum[:]},
+		Version: version,
+	}
+}
+
+// hashedPaths returns the paths of the target name in a repository with
+// consistent snapshots, relative to the targets directory.
+func hashedPaths(name string, hashes metadata.Hashes) []string {
+	dir, file := path.Split(name)
+	paths := make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		paths = append(paths, dir+hex.EncodeToString(h)+"."+file)
+	}
+	slices.Sort(paths)
+	return paths
+}
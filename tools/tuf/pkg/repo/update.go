@@ -0,0 +1,384 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"knative.dev/pkg/logging"
+)
+
+// UpdateRepoWithOptions updates the targets of the existing TUF repository in
+// dir (as returned by LoadRepo) so that they match the targets
+// CreateRepoWithOptions would create for files and options. Targets that are
+// new or changed are added, targets that are no longer present are removed.
+// The keys of the repository are kept. The delegations of the repository
+// can't be changed, so CreateRepoOptions.Delegations either has to list them
+// as they were created or be empty.
+func UpdateRepoWithOptions(ctx context.Context, dir string, files map[string][]byte, options CreateRepoOptions) (LocalStore, error) {
+	// Keep the validity periods of the current trusted root and signing
+	// config, so that the same inputs result in the same targets and
+	// artifacts signed earlier still verify.
+	previous, err := readValidityPeriods(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	targets, err := constructTargets(files, options, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := targetNames(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	remove := []string{}
+	for _, name := range existing {
+		if !slices.ContainsFunc(targets, func(t TargetWithMetadata) bool { return t.Name == name }) {
+			remove = append(remove, name)
+		}
+	}
+	slices.Sort(remove)
+
+	return updateTargets(ctx, dir, targets, remove, options.Roles, options.Delegations)
+}
+
+// targetNames returns the names of the targets of the targets role and the
+// delegated roles of the repository in fsys.
+func targetNames(fsys fs.FS) ([]string, error) {
+	targets, err := readMetadata[metadata.TargetsType](fsys, "repository/targets.json")
+	if err != nil {
+		return nil, err
+	}
+	names := slices.Collect(maps.Keys(targets.Signed.Targets))
+	if targets.Signed.Delegations == nil {
+		return names, nil
+	}
+	for _, role := range targets.Signed.Delegations.Roles {
+		if !delegationNameRegexp.MatchString(role.Name) {
+			return nil, fmt.Errorf("unsupported delegated role name %q", role.Name)
+		}
+		delegated, err := readMetadata[metadata.TargetsType](fsys, path.Join("repository", role.Name+".json"))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, slices.Collect(maps.Keys(delegated.Signed.Targets))...)
+	}
+	return names, nil
+}
+
+// readTarget returns the content of the target name of the repository in
+// fsys, or nil if the repository has no such target.
+func readTarget(fsys fs.FS, name string) ([]byte, error) {
+	targets, err := readMetadata[metadata.TargetsType](fsys, "repository/targets.json")
+	if err != nil {
+		return nil, err
+	}
+	target, ok := targets.Signed.Targets[name]
+	if !ok && targets.Signed.Delegations != nil {
+		for _, role := range targets.Signed.Delegations.Roles {
+			if !delegationNameRegexp.MatchString(role.Name) {
+				return nil, fmt.Errorf("unsupported delegated role name %q", role.Name)
+			}
+			delegated, err := readMetadata[metadata.TargetsType](fsys, path.Join("repository", role.Name+".json"))
+			if err != nil {
+				return nil, err
+			}
+			if target, ok = delegated.Signed.Targets[name]; ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+	b, err := fs.ReadFile(fsys, path.Join("repository", "targets", hashedPaths(name, target.Hashes)[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// validityPeriod is the validity period of a transparency log, certificate
+// authority or service.
+type validityPeriod struct {
+	start, end time.Time
+}
+
+// validityPeriods holds the validity periods of the transparency logs and
+// certificate authorities in the trusted root and the services in the
+// signing config of an existing repository. A nil *validityPeriods is empty.
+type validityPeriods struct {
+	// logs are keyed by the usage and hex encoded ID of the log.
+	logs map[string]validityPeriod
+	// chains are keyed by chainID.
+	chains map[string]validityPeriod
+	// services are keyed by the service name and URL.
+	services map[string]validityPeriod
+}
+
+// readValidityPeriods returns the validity periods in trusted_root.json and
+// signing_config.v0.2.json of the repository in fsys.
+func readValidityPeriods(fsys fs.FS) (*validityPeriods, error) {
+	v := &validityPeriods{
+		logs:     map[string]validityPeriod{},
+		chains:   map[string]validityPeriod{},
+		services: map[string]validityPeriod{},
+	}
+
+	b, err := readTarget(fsys, "trusted_root.json")
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		tr, err := root.NewTrustedRootFromJSON(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the current trusted_root.json: %w", err)
+		}
+		for usage, logs := range map[string]map[string]*root.TransparencyLog{RekorTarget: tr.RekorLogs(), CTFETarget: tr.CTLogs()} {
+			for id, l := range logs {
+				v.logs[usage+" "+id] = validityPeriod{l.ValidityPeriodStart, l.ValidityPeriodEnd}
+			}
+		}
+		for _, ca := range tr.FulcioCertificateAuthorities() {
+			if ca, ok := ca.(*root.FulcioCertificateAuthority); ok {
+				v.chains[chainID(ca.Root, ca.Intermediates, nil)] = validityPeriod{ca.ValidityPeriodStart, ca.ValidityPeriodEnd}
+			}
+		}
+		for _, tsa := range tr.TimestampingAuthorities() {
+			if tsa, ok := tsa.(*root.SigstoreTimestampingAuthority); ok {
+				v.chains[chainID(tsa.Root, tsa.Intermediates, tsa.Leaf)] = validityPeriod{tsa.ValidityPeriodStart, tsa.ValidityPeriodEnd}
+			}
+		}
+	}
+
+	b, err = readTarget(fsys, "signing_config.v0.2.json")
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		sc, err := root.NewSigningConfigFromJSON(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the current signing_config.v0.2.json: %w", err)
+		}
+		for name, services := range map[string][]root.Service{
+			"fulcio": sc.FulcioCertificateAuthorityURLs(),
+			"oidc":   sc.OIDCProviderURLs(),
+			"rekor":  sc.RekorLogURLs(),
+			"tsa":    sc.TimestampAuthorityURLs(),
+		} {
+			for _, s := range services {
+				v.services[name+" "+s.URL] = validityPeriod{s.ValidityPeriodStart, s.ValidityPeriodEnd}
+			}
+		}
+	}
+	return v, nil
+}
+
+// log sets the validity start of tlog, the log with usage and the hex
+// encoded ID id, back to the one it had before, if any. It returns when the
+// log expired if it had already expired before, or now.
+func (v *validityPeriods) log(tlog *root.TransparencyLog, usage, id string, now time.Time) time.Time {
+	if v == nil {
+		return now
+	}
+	p, ok := v.logs[usage+" "+id]
+	if !ok {
+		return now
+	}
+	tlog.ValidityPeriodStart = p.start
+	if !p.end.IsZero() {
+		return p.end
+	}
+	return now
+}
+
+// chain returns when the certificate chain id, which is valid until end,
+// expired if it had already expired before, or now.
+func (v *validityPeriods) chain(id string, end, now time.Time) time.Time {
+	if v == nil {
+		return now
+	}
+	if p, ok := v.chains[id]; ok && p.end.Before(end) {
+		return p.end
+	}
+	return now
+}
+
+// service returns the validity start the service name with url had before,
+// or now if it is new.
+func (v *validityPeriods) service(name, url string, now time.Time) time.Time {
+	if v == nil {
+		return now
+	}
+	if p, ok := v.services[name+" "+url]; ok {
+		return p.start
+	}
+	return now
+}
+
+// chainID identifies a certificate chain by the hash of its certificates.
+func chainID(rootCert *x509.Certificate, intermediates []*x509.Certificate, leaf *x509.Certificate) string {
+	h := sha256.New()
+	for _, c := range slices.Concat([]*x509.Certificate{rootCert}, intermediates, []*x509.Certificate{leaf}) {
+		if c != nil {
+			h.Write(c.Raw)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UpdateTargets adds the given targets to the existing TUF repository in dir
+// (as returned by LoadRepo), replacing existing targets with the same name,
+// and removes the targets named in remove. New versions of the targets,
+// snapshot and timestamp metadata are then signed with the keys of the
+// repository and committed. Targets that did not change are left alone, and
+// if nothing changed at all no new versions are created.
+// Targets delegated to a delegated role are added to and removed from the
+// metadata of that role instead, so if only those change the keys of the
+// targets role are not needed. Delegated roles keep their expiration.
+func UpdateTargets(ctx context.Context, dir string, targets []TargetWithMetadata, remove []string, roles map[string]RoleOptions) (LocalStore, error) {
+	return updateTargets(ctx, dir, targets, remove, roles, nil)
+}
+
+// updateTargets is UpdateTargets, with the expiration of the delegated roles
+// configured by delegations. Delegated roles without a configured expiration
+// keep the one they have, unless it has passed.
+func updateTargets(ctx context.Context, dir string, targets []TargetWithMetadata, remove []string, roles map[string]RoleOptions, delegations []Delegation) (LocalStore, error) {
+	if err := validateRoles(roles); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+	if err := validateDelegations(delegations); err != nil {
+		return nil, fmt.Errorf("invalid delegations: %w", err)
+	}
+
+	fsys := newDirFS(dir)
+	r, err := openTUFRepo(fsys, roles)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkDelegations(delegations); err != nil {
+		return nil, err
+	}
+	// changed holds the roles whose targets changed.
+	changed := map[string]bool{}
+
+	for _, t := range targets {
+		role, md, err := r.targetsRole(t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the role of target %s: %w", t.Name, err)
+		}
+		if current, ok := md.Signed.Targets[t.Name]; ok {
+			same, err := sameTarget(current, t)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare target %s: %w", t.Name, err)
+			}
+			if same {
+				continue
+			}
+			logging.FromContext(ctx).Infof("Replacing file: %s", t.Name)
+		} else {
+			logging.FromContext(ctx).Infof("Adding file: %s", t.Name)
+		}
+		if err := r.addTarget(t.Name, t.Bytes, t.CustomMetadata); err != nil {
+			return nil, fmt.Errorf("failed to add target %s: %w", t.Name, err)
+		}
+		changed[role] = true
+	}
+
+	for _, name := range remove {
+		role, md, err := r.targetsRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the role of target %s: %w", name, err)
+		}
+		if _, ok := md.Signed.Targets[name]; !ok {
+			return nil, fmt.Errorf("target %s does not exist", name)
+		}
+		logging.FromContext(ctx).Infof("Removing file: %s", name)
+		delete(md.Signed.Targets, name)
+		changed[role] = true
+	}
+
+	if len(changed) == 0 {
+		logging.FromContext(ctx).Infof("Targets are up to date, nothing to publish")
+		return fsStore{fsys}, nil
+	}
+
+	now := time.Now()
+	for _, role := range slices.Sorted(maps.Keys(changed)) {
+		md, o, sign := r.targets, roles["targets"], r.signTargets
+		keepExpires := false
+		if role != "targets" {
+			md, o = r.delegated[role], delegationOptions(delegations, role)
+			sign = func() error { return r.signDelegation(role) }
+			keepExpires = o.Expires == 0 && md.Signed.Expires.After(now)
+		}
+		md.Signed.Version++
+		if !keepExpires {
+			md.Signed.Expires = o.expires(now)
+		}
+		md.ClearSignatures()
+		if err := sign(); err != nil {
+			return nil, err
+		}
+		logging.FromContext(ctx).Infof("Signed %s version %d", role, md.Signed.Version)
+	}
+	if err := r.signOnlineRoles(roles, now); err != nil {
+		return nil, err
+	}
+	if err := r.write(); err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Infof("Published snapshot version %d", r.snapshot.Signed.Version)
+	return fsStore{fsys}, nil
+}
+
+// sameTarget returns true if target has the same content and custom metadata
+// as the one described by current.
+func sameTarget(current *metadata.TargetFiles, target TargetWithMetadata) (bool, error) {
+	meta, err := metadata.TargetFile().FromBytes(target.Name, target.Bytes, slices.Collect(maps.Keys(current.Hashes))...)
+	if err != nil {
+		return false, err
+	}
+	if !meta.Equal(*current) {
+		return false, nil
+	}
+	if current.Custom == nil || len(target.CustomMetadata) == 0 {
+		return current.Custom == nil && len(target.CustomMetadata) == 0, nil
+	}
+	// The stored custom metadata may have been indented.
+	var currentCustom, targetCustom bytes.Buffer
+	if err := json.Compact(&currentCustom, *current.Custom); err != nil {
+		return false, err
+	}
+	if err := json.Compact(&targetCustom, target.CustomMetadata); err != nil {
+		return false, err
+	}
+	return bytes.Equal(currentCustom.Bytes(), targetCustom.Bytes()), nil
+}
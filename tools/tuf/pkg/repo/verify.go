@@ -0,0 +1,110 @@
+// Copyright 2026 The Sigstore Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore-go/pkg/root"
+	sigstoretuf "github.com/sigstore/sigstore-go/pkg/tuf"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"knative.dev/pkg/logging"
+)
+
+// verifyBaseURL is the URL the TUF client of VerifyRepo fetches the
+// repository from, which fsFetcher maps to the "repository" directory.
+const verifyBaseURL = "file:///repository"
+
+// VerifyRepo checks that the TUF repository in fsys, laid out like the
+// directory returned by CreateRepoWithOptions, can be consumed by clients.
+// Starting from 1.root.json, a sigstore-go TUF client updates to the latest
+// metadata and fetches every target of the repository, and trusted_root.json
+// and signing_config.v0.2.json are parsed if they are present.
+func VerifyRepo(ctx context.Context, fsys fs.FS) error {
+	initialRoot, err := fs.ReadFile(fsys, "repository/1.root.json")
+	if err != nil {
+		return fmt.Errorf("failed to read initial root: %w", err)
+	}
+	c, err := sigstoretuf.New(&sigstoretuf.Options{
+		Root:              initialRoot,
+		RepositoryBaseURL: verifyBaseURL,
+		DisableLocalCache: true,
+		Fetcher:           fsFetcher{fsys},
+		Context:           ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("TUF client failed to update from 1.root.json: %w", err)
+	}
+
+	names, err := targetNames(fsys)
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		content, err := c.GetTarget(name)
+		if err != nil {
+			return fmt.Errorf("TUF client failed to get target %s: %w", name, err)
+		}
+		switch name {
+		case "trusted_root.json":
+			if _, err := root.NewTrustedRootFromJSON(content); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+		case "signing_config.v0.2.json":
+			if _, err := root.NewSigningConfigFromJSON(content); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+		}
+	}
+	logging.FromContext(ctx).Infof("Verified the TUF repository with a TUF client, got %d targets", len(names))
+	return nil
+}
+
+// fsFetcher fetches the files of a TUF repository from the "repository"
+// directory of fsys instead of over HTTP.
+type fsFetcher struct {
+	fsys fs.FS
+}
+
+func (f fsFetcher) DownloadFile(urlPath string, maxLength int64, _ time.Duration) ([]byte, error) {
+	u, err := url.Parse(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Clean(strings.TrimPrefix(u.Path, "/"))
+	if !strings.HasPrefix(name, "repository/") {
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: 404, URL: urlPath}
+	}
+	content, err := fs.ReadFile(f.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Clients look for newer root versions until they are not found.
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: 404, URL: urlPath}
+	} else if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxLength {
+		return nil, &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("%s is larger than %d bytes", name, maxLength)}
+	}
+	return content, nil
+}